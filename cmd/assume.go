@@ -7,8 +7,8 @@ import (
 	"path/filepath"
 
 	awssdk "github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/sjenning/sts-preflight/pkg/awssession"
 	"github.com/sjenning/sts-preflight/pkg/cmd/create"
 	"github.com/spf13/cobra"
 )
@@ -41,22 +41,7 @@ func execute() {
 		log.Fatal(err)
 	}
 
-	cfg := &awssdk.Config{
-		Region: awssdk.String(state.Region),
-	}
-
-	s, err := session.NewSession(cfg)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-
-	stsClient := sts.New(s)
-
-	output, err := stsClient.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
-		RoleArn:          awssdk.String(state.RoleARN),
-		WebIdentityToken: awssdk.String(string(tokenBytes)),
-		RoleSessionName:  awssdk.String(fmt.Sprintf("%s-installer-session", state.InfraName)),
-	})
+	output, err := assumeInstallerRole(&state, tokenBytes)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -66,3 +51,22 @@ func execute() {
 	fmt.Printf("export AWS_SECRET_ACCESS_KEY=%s\n", *output.Credentials.SecretAccessKey)
 	fmt.Printf("export AWS_SESSION_TOKEN=%s\n", *output.Credentials.SessionToken)
 }
+
+// assumeInstallerRole exchanges the token for credentials of the installer
+// role.
+func assumeInstallerRole(state *create.State, token []byte) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	config := create.Config{Region: state.Region}
+	if state.Config != nil {
+		config = *state.Config
+	}
+	s, err := awssession.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return sts.New(s).AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          awssdk.String(state.RoleARN),
+		WebIdentityToken: awssdk.String(string(token)),
+		RoleSessionName:  awssdk.String(fmt.Sprintf("%s-installer-session", state.InfraName)),
+	})
+}
@@ -1,44 +1,409 @@
 package cmd
 
 import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+	"github.com/sjenning/sts-preflight/pkg/check"
 	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/cmd/token"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/iamroles"
+	"github.com/sjenning/sts-preflight/pkg/installdir"
+	"github.com/sjenning/sts-preflight/pkg/installerpolicy"
 	"github.com/sjenning/sts-preflight/pkg/jwks"
+	"github.com/sjenning/sts-preflight/pkg/jwt"
+	"github.com/sjenning/sts-preflight/pkg/plan"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
+	"github.com/sjenning/sts-preflight/pkg/rollback"
 	"github.com/sjenning/sts-preflight/pkg/rsa"
 	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
 	"github.com/spf13/cobra"
 )
 
 var (
-	createConfig create.Config
-	createState  create.State
+	createConfig      create.Config
+	createState       create.State
+	createDryRun      bool
+	createCheck       bool
+	planOutput        string
+	createOnFailure   string
+	createWait        bool
+	createWaitTimeout time.Duration
+)
+
+const (
+	onFailurePrompt   = "prompt"
+	onFailureRollback = "rollback"
+	onFailureKeep     = "keep"
 )
 
 var createCmd = &cobra.Command{
 	Use:   "create",
 	Short: "Creates STS infrastructure in AWS",
 	Run: func(cmd *cobra.Command, args []string) {
+		defer exitOnPanic()
+
+		validateServiceAccountTrust(createConfig.ServiceAccountTrust)
+
+		for _, feature := range createConfig.InstallerFeatures {
+			if !containsString(installerpolicy.Features(), feature) {
+				log.Fatalf("Invalid --installer-permissions %q, must be one of %v", feature, installerpolicy.Features())
+			}
+		}
+
+		if err := awssession.ValidateRegion(createConfig.Region); err != nil {
+			log.Fatalf("Invalid --region: %s", err)
+		}
+
+		if createConfig.MaxSessionDuration < 3600 || createConfig.MaxSessionDuration > 43200 {
+			log.Fatalf("Invalid --max-session-duration %d, must be between 3600 and 43200", createConfig.MaxSessionDuration)
+		}
+		if createConfig.Concurrency < 1 {
+			log.Fatalf("Invalid --concurrency %d, must be at least 1", createConfig.Concurrency)
+		}
+		if !strings.HasPrefix(createConfig.RolePath, "/") || !strings.HasSuffix(createConfig.RolePath, "/") {
+			log.Fatalf("Invalid --role-path %q, must begin and end with /", createConfig.RolePath)
+		}
+
+		if planOutput != "text" && planOutput != "json" {
+			log.Fatalf("Invalid --output %q, must be text or json", planOutput)
+		}
+		switch createOnFailure {
+		case onFailurePrompt, onFailureRollback, onFailureKeep:
+		default:
+			log.Fatalf("Invalid --on-failure %q, must be %s, %s or %s", createOnFailure, onFailurePrompt, onFailureRollback, onFailureKeep)
+		}
+
+		switch createConfig.Target {
+		case create.TargetOpenShift, create.TargetKubernetes:
+		default:
+			log.Fatalf("Invalid --target %q, must be %s or %s", createConfig.Target, create.TargetOpenShift, create.TargetKubernetes)
+		}
+		if createConfig.Target == create.TargetKubernetes && createConfig.InstallDir != "" {
+			log.Fatalf("--install-dir is for openshift-install and cannot be used with --target %s", create.TargetKubernetes)
+		}
+
+		switch createConfig.BucketEncryption {
+		case "", create.BucketEncryptionSSES3, create.BucketEncryptionSSEKMS:
+		default:
+			log.Fatalf("Invalid --bucket-encryption %q, must be %s or %s", createConfig.BucketEncryption, create.BucketEncryptionSSES3, create.BucketEncryptionSSEKMS)
+		}
+		if createConfig.BucketKMSKeyID != "" && createConfig.BucketEncryption != create.BucketEncryptionSSEKMS {
+			log.Fatalf("--bucket-kms-key-id needs --bucket-encryption %s", create.BucketEncryptionSSEKMS)
+		}
+		if createConfig.BucketNoncurrentVersionExpirationDays < 0 {
+			log.Fatalf("Invalid --bucket-noncurrent-version-expiration-days %d, must not be negative", createConfig.BucketNoncurrentVersionExpirationDays)
+		}
+
+		if (createConfig.ExternalID != "" || createConfig.MFASerial != "") && createConfig.AssumeRoleARN == "" {
+			log.Fatal("--external-id and --mfa-serial need --assume-role-arn")
+		}
+
+		if createConfig.ExternalIssuerURL != "" && createWait {
+			log.Fatal("--wait signs a token with the generated key and cannot be used with --issuer-url")
+		}
+
+		if createConfig.ExternalIssuerURL != "" && createConfig.InstallDir != "" {
+			log.Fatal("--install-dir copies the generated signing key and cannot be used with --issuer-url")
+		}
+
+		if createConfig.InstallDir != "" {
+			installdir.Validate(createConfig, createConfig.InstallDir)
+		}
+
+		var crs []credreqs.CredentialsRequest
+		if len(createConfig.CredentialsRequestsFiles) > 0 {
+			crs = credreqs.Load(createConfig)
+			if !lintCredentialsRequests(crs, createConfig.ServiceAccountTrust) {
+				log.Fatal("CredentialsRequests failed linting, not creating anything")
+			}
+		}
+		if _, err := iamroles.ParseAdditionalProfiles(createConfig.AdditionalProfiles, crs); err != nil {
+			log.Fatalf("Invalid --additional-profile: %s", err)
+		}
+		var sas []podidentity.ServiceAccountRole
+		if createConfig.ServiceAccountRolesFile != "" {
+			sas = podidentity.Load(createConfig)
+		}
+
+		if createCheck {
+			report := check.Run(createConfig, crs, sas)
+			if planOutput == "json" {
+				report.PrintJSON(os.Stdout)
+			} else {
+				report.Print(os.Stdout)
+			}
+			if !report.Passed {
+				os.Exit(1)
+			}
+			return
+		}
+
+		if createDryRun {
+			createState.ReadIfExists()
+			p := plan.New(createConfig, &createState, crs, sas)
+			if planOutput == "json" {
+				p.PrintJSON(os.Stdout)
+			} else {
+				p.Print(os.Stdout)
+			}
+			return
+		}
+
 		os.Mkdir(createConfig.TargetDir, 0700)
 
+		if createState.ReadIfExists() && len(createState.Journal) > 0 {
+			if createState.InfraName != createConfig.InfraName {
+				log.Fatalf("state.json holds an unfinished create of %s, finish or roll it back first", createState.InfraName)
+			}
+			log.Printf("Resuming the unfinished create journaled in state.json (%d steps)", len(createState.Journal))
+		}
+
 		createState.InfraName = createConfig.InfraName
 		createState.Region = createConfig.Region
-		rsa.New(createConfig.TargetDir)
-		jwks.New(&createState, createConfig.TargetDir)
-		s3endpoint.New(createConfig, &createState)
+		if createConfig.ExternalIssuerURL == "" {
+			rsa.New(createConfig.TargetDir, createConfig.Target != create.TargetKubernetes)
+			jwks.New(&createState, createConfig.TargetDir)
+		}
+
+		createState.Config = &createConfig
+		createState.BeginRun()
+		runCreate(crs, sas)
+
+		if createConfig.InstallDir != "" {
+			installdir.Install(createConfig, createConfig.InstallDir)
+		} else if createConfig.Target != create.TargetKubernetes {
+			// The cloud-credential-operator renders its bootstrap config from
+			// the credentialsMode openshift-install stores in
+			// kube-system/cluster-config-v1, not from the manifests.
+			log.Print("Set credentialsMode: Manual in install-config.yaml, or the cloud-credential-operator starts in its default mode")
+		}
+		if createWait {
+			waitForInstallerRole()
+		}
+	},
+}
+
+// runCreate creates or reconciles everything. On failure or interruption it
+// rolls back the journaled steps or keeps them for a re-run to resume, as
+// --on-failure says.
+func runCreate(crs []credreqs.CredentialsRequest, sas []podidentity.ServiceAccountRole) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if !loggedPanic(r) {
+			panic(r)
+		}
 		createState.Write()
+
+		if rollbackOnFailure(createdSteps(true), "this create") {
+			rollbackCreate(false)
+		}
+		// The steps of the runs this one resumed are only rolled back
+		// when asked for separately.
+		if older := createdSteps(false); older > 0 && createOnFailure == onFailurePrompt &&
+			rollbackOnFailure(older, "the earlier unfinished creates this one resumed") {
+			rollbackCreate(true)
+		}
+		if len(createState.Journal) > 0 {
+			log.Printf("Kept the %d journaled steps in state.json, re-run create to resume", len(createState.Journal))
+		}
+		os.Exit(1)
+	}()
+	// Only journaled steps can stop at an interrupt; --wait and
+	// --install-dir are left to the default handling.
+	defer create.CatchInterrupts()()
+
+	s3endpoint.New(createConfig, &createState, crs, sas)
+	createState.Journal = nil
+	createState.Write()
+}
+
+// createdSteps counts the journaled resource creations of this run, or of
+// the earlier runs it resumed.
+func createdSteps(thisRun bool) int {
+	created := 0
+	for _, step := range createState.Journal {
+		if step.Action == create.StepCreated && createState.InRun(step) == thisRun {
+			created++
+		}
+	}
+	return created
+}
+
+// rollbackOnFailure decides whether to roll back the resources created by a
+// failed create, asking on the terminal with --on-failure prompt.
+func rollbackOnFailure(created int, by string) bool {
+	if created == 0 {
+		return false
+	}
+
+	switch createOnFailure {
+	case onFailureRollback:
+		return true
+	case onFailureKeep:
+		return false
+	}
+
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		log.Print("Not asking to roll back, stdin is not a terminal")
+		return false
+	}
+	fmt.Printf("Roll back the %d resources created by %s? [y/N] ", created, by)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// rollbackCreate rolls back the resources created by this run, or by every
+// journaled run with all.
+func rollbackCreate(all bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !loggedPanic(r) {
+				panic(r)
+			}
+			log.Printf("Rollback failed, the remaining %d steps are kept in state.json", len(createState.Journal))
+			os.Exit(1)
+		}
+	}()
+
+	rollback.Run(createConfig, &createState, all)
+	log.Print("Rolled back")
+}
+
+// waitForInstallerRole polls until a fresh token can be exchanged for
+// credentials of the installer role, which IAM takes a while to propagate.
+func waitForInstallerRole() {
+	jwt.New(token.Config{ExpireSeconds: 3600}, createConfig.TargetDir)
+	tokenBytes, err := ioutil.ReadFile(filepath.Join(createConfig.TargetDir, "token"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deadline := time.Now().Add(createWaitTimeout)
+	for {
+		_, err := assumeInstallerRole(&createState, tokenBytes)
+		if err == nil {
+			log.Print("Installer Role can be assumed")
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Fatalf("Installer Role still cannot be assumed after %s: %s", createWaitTimeout, err)
+		}
+		log.Printf("Installer Role cannot be assumed yet: %s", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// exitOnPanic exits on the panics the AWS packages fail with, whose message
+// has already been logged. Any other panic is a bug and keeps its stack trace.
+func exitOnPanic() {
+	if r := recover(); r != nil {
+		if !loggedPanic(r) {
+			panic(r)
+		}
+		os.Exit(1)
+	}
+}
+
+// loggedPanic reports whether a recovered value comes from log.Panic, which
+// panics with the message it logged. The AWS packages and an interrupted
+// create fail that way; runtime errors and other panics do not.
+func loggedPanic(r interface{}) bool {
+	_, ok := r.(string)
+	return ok
+}
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Shows what create would change in AWS, without changing anything",
+	Run: func(cmd *cobra.Command, args []string) {
+		createDryRun = true
+		createCmd.Run(cmd, args)
+	},
+}
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks that create can succeed: names, bucket ownership, permissions and quotas",
+	Run: func(cmd *cobra.Command, args []string) {
+		createCheck = true
+		createCmd.Run(cmd, args)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(createCmd)
+	addCredentialsRequestsFlags(createCmd, &createConfig)
 
 	createCmd.PersistentFlags().StringVar(&createConfig.InfraName, "infra-name", "", "Name prefix for all created AWS resources")
 	createCmd.MarkPersistentFlagRequired("infra-name")
-	createCmd.PersistentFlags().StringVar(&createConfig.CredentialsRequestsFile, "credentials-requests-to-roles", "", "Process the (yaml) list of CredentialsRequests into AWS IAM Roles")
+	createCmd.PersistentFlags().StringVar(&createConfig.RoleNameTemplate, "role-name-template", create.DefaultRoleNameTemplate, "Go template for CredentialsRequest role names, with fields .InfraName, .Namespace, .Name, .SecretNamespace and .SecretName")
+
+	createCmd.PersistentFlags().StringSliceVar(&createConfig.InstallerPolicyARNs, "installer-policy-arn", nil, "Managed policy ARN to attach to the installer Role instead of AdministratorAccess (may be repeated)")
+	createCmd.PersistentFlags().StringVar(&createConfig.InstallerInlinePolicyFile, "installer-inline-policy-file", "", "JSON policy document to put on the installer Role as an inline policy instead of attaching AdministratorAccess")
+	createCmd.PersistentFlags().StringSliceVar(&createConfig.InstallerFeatures, "installer-permissions", nil, fmt.Sprintf("Put the minimum openshift-install permissions for these install features on the installer Role instead of attaching AdministratorAccess, any of %v", installerpolicy.Features()))
+
+	createCmd.PersistentFlags().StringVar(&createConfig.Profile, "profile", "", "Shared config profile to take AWS credentials from")
+	createCmd.PersistentFlags().StringVar(&createConfig.SharedConfigFile, "shared-config-file", "", "Shared config file to use instead of ~/.aws/config")
+	createCmd.PersistentFlags().StringVar(&createConfig.AssumeRoleARN, "assume-role-arn", "", "Admin Role to assume with the AWS credentials and do everything as")
+	createCmd.PersistentFlags().StringVar(&createConfig.ExternalID, "external-id", "", "External ID to assume --assume-role-arn with")
+	createCmd.PersistentFlags().StringVar(&createConfig.MFASerial, "mfa-serial", "", "MFA device to assume --assume-role-arn with; the code is read from stdin")
+
+	createCmd.PersistentFlags().StringVar(&createConfig.EndpointURL, "endpoint-url", "", "Endpoint URL for S3, IAM and STS, such as an AWS emulator, with path-style S3 addressing")
+	createCmd.PersistentFlags().StringVar(&createConfig.S3EndpointURL, "s3-endpoint-url", "", "Endpoint URL for S3 instead of --endpoint-url, with path-style addressing")
+	createCmd.PersistentFlags().StringVar(&createConfig.IAMEndpointURL, "iam-endpoint-url", "", "Endpoint URL for IAM instead of --endpoint-url")
+	createCmd.PersistentFlags().StringVar(&createConfig.STSEndpointURL, "sts-endpoint-url", "", "Endpoint URL for STS instead of --endpoint-url")
+	createCmd.PersistentFlags().StringVar(&createConfig.CABundle, "ca-bundle", "", "PEM file of CA certificates to trust besides the system roots, such as that of an HTTPS_PROXY intercepting TLS")
+
+	createCmd.PersistentFlags().StringVar(&createConfig.BucketEncryption, "bucket-encryption", "", "Default encryption of the issuer bucket, sse-s3 or sse-kms; the issuer documents themselves are always encrypted with S3 managed keys so that they stay readable")
+	createCmd.PersistentFlags().StringVar(&createConfig.BucketKMSKeyID, "bucket-kms-key-id", "", "KMS key for --bucket-encryption sse-kms instead of the AWS managed key")
+	createCmd.PersistentFlags().BoolVar(&createConfig.BucketVersioning, "bucket-versioning", false, "Enable versioning of the issuer bucket")
+	createCmd.PersistentFlags().StringVar(&createConfig.BucketLoggingTarget, "bucket-logging-target", "", "Bucket, with an optional /prefix, to deliver the access logs of the issuer bucket to")
+	createCmd.PersistentFlags().Int64Var(&createConfig.BucketNoncurrentVersionExpirationDays, "bucket-noncurrent-version-expiration-days", 0, "Add a lifecycle rule to the issuer bucket that expires replaced versions after this many days and cleans up incomplete uploads")
+
+	createCmd.PersistentFlags().StringToStringVar(&createConfig.Tags, "tags", nil, fmt.Sprintf("Tags (key=value) to apply to every created resource in addition to %s", create.InfraNameTagKey))
+	createCmd.PersistentFlags().StringVar(&createConfig.RolePath, "role-path", "/", "IAM path for created Roles")
+	createCmd.PersistentFlags().StringVar(&createConfig.PermissionsBoundaryARN, "permissions-boundary-arn", "", "ARN of a managed policy to set as the permissions boundary of created Roles")
+	createCmd.PersistentFlags().Int64Var(&createConfig.MaxSessionDuration, "max-session-duration", 3600, "Maximum session duration in seconds (3600-43200) for created Roles")
+
+	createCmd.PersistentFlags().BoolVar(&createConfig.STSRegionalEndpoints, "sts-regional-endpoints", true, "Make the credentials Secrets use the regional STS endpoint of --region")
+	createCmd.PersistentFlags().StringSliceVar(&createConfig.AdditionalProfiles, "additional-profile", nil, "Add a profile for the Role of another CredentialsRequest to a credentials Secret, as <namespace>/<name>:<profile>=<namespace>/<name> (may be repeated)")
+
+	createCmd.PersistentFlags().StringVar(&createConfig.ServiceAccountRolesFile, "service-account-roles", "", "YAML or JSON list of ServiceAccounts (namespace, serviceAccount, statements) to create Roles for, emitting annotated ServiceAccount and pod identity webhook manifests")
+	createCmd.PersistentFlags().StringVar(&createConfig.PodIdentityWebhookImage, "pod-identity-webhook-image", podidentity.DefaultWebhookImage, "Image of the pod identity webhook deployed for --service-account-roles")
+
+	createCmd.PersistentFlags().IntVar(&createConfig.Concurrency, "concurrency", 8, "Number of CredentialsRequest Roles to create or update at the same time")
 
 	createCmd.PersistentFlags().StringVar(&createConfig.Region, "region", "", "AWS region were the s3 OIDC endpoint will be created")
 	createCmd.MarkPersistentFlagRequired("region")
 
 	createCmd.PersistentFlags().StringVar(&createConfig.TargetDir, "dir", "_output", "Directory to read/write manifests into")
+	createCmd.PersistentFlags().StringVar(&createConfig.ExternalIssuerURL, "issuer-url", "", "Existing https OIDC issuer to trust, instead of generating a key pair and hosting the issuer in an S3 bucket")
+	createCmd.PersistentFlags().StringVar(&createConfig.Target, "target", create.TargetOpenShift, "Kind of cluster to write the issuer configuration for: openshift (manifests and installer signing key) or kubernetes (kube-apiserver flags, kubeadm and kind configurations)")
+
+	createCmd.PersistentFlags().StringVar(&planOutput, "output", "text", "Format of the --dry-run plan or the check report, text or json")
+	createCmd.Flags().BoolVar(&createDryRun, "dry-run", false, "Only show what would be created or updated in AWS")
+	createCmd.PersistentFlags().StringVar(&createConfig.InstallDir, "install-dir", "", "openshift-install directory to check and to copy the manifests and signing key into, setting credentialsMode Manual in its install-config.yaml")
+	createCmd.Flags().BoolVar(&createWait, "wait", false, "Wait until the installer Role can be assumed with a fresh token")
+	createCmd.Flags().DurationVar(&createWaitTimeout, "wait-timeout", 5*time.Minute, "How long --wait waits for the installer Role")
+	createCmd.Flags().StringVar(&createOnFailure, "on-failure", onFailurePrompt, "What to do with the resources created so far when create fails or is interrupted: prompt, rollback or keep (for a re-run to resume)")
+
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().AddFlagSet(createCmd.PersistentFlags())
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().AddFlagSet(createCmd.PersistentFlags())
 }
@@ -1,30 +1,44 @@
 package cmd
 
 import (
-	"fmt"
+	"log"
 
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/destroy"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
 	"github.com/spf13/cobra"
 )
 
 // destroyCmd represents the destroy command
 var destroyCmd = &cobra.Command{
 	Use:   "destroy",
-	Short: "Removes STS infrastructure from AWS (not implemented yet)",
+	Short: "Removes the STS infrastructure create made in AWS",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("destroy called")
+		defer exitOnPanic()
+
+		var state create.State
+		state.Read()
+		if state.Config == nil {
+			log.Fatal("state.json does not record the create configuration, so what create made is unknown")
+		}
+		config := *state.Config
+
+		var crs []credreqs.CredentialsRequest
+		if len(config.CredentialsRequestsFiles) > 0 {
+			crs = credreqs.Load(config)
+		}
+
+		var sas []podidentity.ServiceAccountRole
+		if config.ServiceAccountRolesFile != "" {
+			sas = podidentity.Load(config)
+		}
+
+		destroy.Run(config, &state, crs, sas)
+		log.Print("Destroyed")
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(destroyCmd)
-
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// destroyCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// destroyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/fakeaws"
+	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
+)
+
+// e2eThumbprint stands in for the thumbprint of the regional S3 host, which
+// the fake does not serve.
+const e2eThumbprint = "0123456789abcdef0123456789abcdef01234567"
+
+const e2eCredentialsRequest = `apiVersion: cloudcredential.openshift.io/v1
+kind: CredentialsRequest
+metadata:
+  name: e2e-operator
+  namespace: openshift-cloud-credential-operator
+spec:
+  secretRef:
+    name: e2e-operator-creds
+    namespace: openshift-e2e
+  serviceAccountNames:
+  - e2e-operator
+  providerSpec:
+    apiVersion: cloudcredential.openshift.io/v1
+    kind: AWSProviderSpec
+    statementEntries:
+    - effect: Allow
+      action:
+      - s3:GetObject
+      resource: "*"
+`
+
+// TestEndToEnd runs create, token, assume and destroy against the fake AWS
+// endpoint, as a user would.
+func TestEndToEnd(t *testing.T) {
+	fake := fakeaws.New()
+	defer fake.Close()
+
+	s3Thumbprint := s3endpoint.S3Thumbprint
+	s3endpoint.S3Thumbprint = func(create.Config) (string, error) { return e2eThumbprint, nil }
+	defer func() { s3endpoint.S3Thumbprint = s3Thumbprint }()
+
+	dir := t.TempDir()
+	chdir(t, dir)
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "fake",
+		"AWS_SECRET_ACCESS_KEY":       "fake",
+		"AWS_CONFIG_FILE":             filepath.Join(dir, "aws-config"),
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "aws-credentials"),
+		"AWS_EC2_METADATA_DISABLED":   "true",
+	} {
+		setenv(t, k, v)
+	}
+
+	crFile := filepath.Join(dir, "credreqs.yaml")
+	if err := ioutil.WriteFile(crFile, []byte(e2eCredentialsRequest), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, "create", "--infra-name", "e2e", "--region", "us-east-1", "--endpoint-url", fake.URL, "--credentials-requests-to-roles", crFile)
+
+	if got, want := fake.Buckets(), []string{"e2e-installer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("buckets after create: got %v, want %v", got, want)
+	}
+	if got, want := fake.OIDCProviders(), []string{"arn:aws:iam::" + fakeaws.AccountID + ":oidc-provider/s3.us-east-1.amazonaws.com/e2e-installer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OIDC providers after create: got %v, want %v", got, want)
+	}
+	if got, want := fake.Roles(), []string{"e2e-installer", "e2e-openshift-e2e-e2e-operator-creds"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("roles after create: got %v, want %v", got, want)
+	}
+	for _, manifest := range []string{"cluster-authentication-02-config.yaml", "cco-cloudcredential-config.yaml", "cco-configmap.yaml", "openshift-e2e-e2e-operator-creds-credentials.yaml"} {
+		if _, err := os.Stat(filepath.Join(dir, "_output", "manifests", manifest)); err != nil {
+			t.Errorf("manifest after create: %s", err)
+		}
+	}
+
+	run(t, "token")
+	output := capture(t, func() { run(t, "assume") })
+	if !strings.Contains(output, "export AWS_ACCESS_KEY_ID=ASIA") {
+		t.Errorf("assume printed no credentials:\n%s", output)
+	}
+
+	var state create.State
+	state.Read()
+	if _, err := assumeInstallerRole(&state, []byte("not-a-token")); err == nil || !strings.Contains(err.Error(), "InvalidIdentityToken") {
+		t.Errorf("assume with an invalid token: got error %v, want InvalidIdentityToken", err)
+	}
+
+	run(t, "destroy")
+
+	if got := fake.Buckets(); len(got) > 0 {
+		t.Errorf("buckets after destroy: %v", got)
+	}
+	if got := fake.OIDCProviders(); len(got) > 0 {
+		t.Errorf("OIDC providers after destroy: %v", got)
+	}
+	if got := fake.Roles(); len(got) > 0 {
+		t.Errorf("roles after destroy: %v", got)
+	}
+}
+
+func run(t *testing.T, args ...string) {
+	t.Helper()
+	rootCmd.SetArgs(args)
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("%s: %s", strings.Join(args, " "), err)
+	}
+}
+
+// capture returns what f writes to stdout.
+func capture(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sjenning/sts-preflight/pkg/installerpolicy"
+	"github.com/spf13/cobra"
+)
+
+var installerPolicyFeatures []string
+
+// installerPolicyCmd represents the installer-policy command
+var installerPolicyCmd = &cobra.Command{
+	Use:   "installer-policy",
+	Short: "Prints the minimum permissions policy for the installer Role",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(installerpolicy.New(installerPolicyFeatures))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(installerPolicyCmd)
+
+	installerPolicyCmd.PersistentFlags().StringSliceVar(&installerPolicyFeatures, "installer-permissions", nil, fmt.Sprintf("Install features to include permissions for, any of %v", installerpolicy.Features()))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
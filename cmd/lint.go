@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/lint"
+	"github.com/spf13/cobra"
+)
+
+var lintConfig create.Config
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Checks the IAM statements of CredentialsRequests",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(lintConfig.CredentialsRequestsFiles) == 0 {
+			log.Fatal("No CredentialsRequests given with --credentials-requests-to-roles")
+		}
+
+		validateServiceAccountTrust(lintConfig.ServiceAccountTrust)
+		if !lintCredentialsRequests(credreqs.Load(lintConfig), lintConfig.ServiceAccountTrust) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+	addCredentialsRequestsFlags(lintCmd, &lintConfig)
+}
+
+// addCredentialsRequestsFlags adds the flags selecting CredentialsRequests.
+func addCredentialsRequestsFlags(cmd *cobra.Command, config *create.Config) {
+	cmd.PersistentFlags().StringSliceVar(&config.CredentialsRequestsFiles, "credentials-requests-to-roles", nil, "Process the CredentialsRequests in these (yaml or json) files, directories or globs into AWS IAM Roles")
+	cmd.PersistentFlags().StringSliceVar(&config.CredentialsRequestsInclude, "credentials-requests-include", nil, "Only process CredentialsRequests whose namespace/name matches one of these globs")
+	cmd.PersistentFlags().StringSliceVar(&config.CredentialsRequestsExclude, "credentials-requests-exclude", nil, "Skip CredentialsRequests whose namespace/name matches one of these globs")
+	cmd.PersistentFlags().StringVar(&config.FeatureSet, "feature-set", credreqs.DefaultFeatureSet, fmt.Sprintf("Cluster feature set, CredentialsRequests annotated with %s for other feature sets are skipped", credreqs.FeatureSetAnnotation))
+	cmd.PersistentFlags().StringVar(&config.ServiceAccountTrust, "service-account-trust", create.ServiceAccountTrustExplicit, "ServiceAccounts allowed to assume CredentialsRequest roles: 'explicit' for those in spec.serviceAccountNames, 'wildcard' for any in the target namespace")
+	cmd.PersistentFlags().StringSliceVar(&config.Capabilities, "capabilities", nil, fmt.Sprintf("Enabled optional cluster capabilities, CredentialsRequests annotated with %s for other capabilities are skipped (%q for none, default all)", credreqs.CapabilityAnnotation, credreqs.NoCapabilities))
+}
+
+// validateServiceAccountTrust exits on an invalid --service-account-trust.
+func validateServiceAccountTrust(trust string) {
+	switch trust {
+	case create.ServiceAccountTrustExplicit, create.ServiceAccountTrustWildcard:
+	default:
+		log.Fatalf("Invalid --service-account-trust %q, must be %q or %q", trust, create.ServiceAccountTrustExplicit, create.ServiceAccountTrustWildcard)
+	}
+}
+
+// lintCredentialsRequests prints the problems found in the CredentialsRequests
+// and reports whether there were no errors.
+func lintCredentialsRequests(crs []credreqs.CredentialsRequest, serviceAccountTrust string) bool {
+	problems := lint.Lint(crs, serviceAccountTrust)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	errors := lint.Errors(problems)
+	log.Printf("Linted %d CredentialsRequests: %d errors, %d warnings", len(crs), errors, len(problems)-errors)
+	return errors == 0
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/plan"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
+	"github.com/spf13/cobra"
+)
+
+// statusDriftExitCode is returned when resources have drifted, to tell drift
+// apart from failures.
+const statusDriftExitCode = 2
+
+var statusOutput string
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Checks the STS infrastructure in AWS for drift from what create configured",
+	Run: func(cmd *cobra.Command, args []string) {
+		defer exitOnPanic()
+
+		if statusOutput != "text" && statusOutput != "json" {
+			log.Fatalf("Invalid --output %q, must be text or json", statusOutput)
+		}
+
+		var state create.State
+		state.Read()
+		if state.Config == nil {
+			log.Fatal("state.json does not record the create configuration, re-run create first")
+		}
+		config := *state.Config
+
+		var crs []credreqs.CredentialsRequest
+		if len(config.CredentialsRequestsFiles) > 0 {
+			crs = credreqs.Load(config)
+		}
+
+		var sas []podidentity.ServiceAccountRole
+		if config.ServiceAccountRolesFile != "" {
+			sas = podidentity.Load(config)
+		}
+
+		status := plan.New(config, &state, crs, sas).Status()
+		if statusOutput == "json" {
+			status.PrintJSON(os.Stdout)
+		} else {
+			status.Print(os.Stdout)
+		}
+		if status.Drifted {
+			os.Exit(statusDriftExitCode)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.PersistentFlags().StringVar(&statusOutput, "output", "text", "Format of the report, text or json")
+}
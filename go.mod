@@ -3,7 +3,7 @@ module github.com/sjenning/sts-preflight
 go 1.15
 
 require (
-	github.com/aws/aws-sdk-go v1.35.15
+	github.com/aws/aws-sdk-go v1.44.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/openshift/cloud-credential-operator v0.0.0-20201119003445-a970421a4c60
@@ -11,5 +11,6 @@ require (
 	github.com/stretchr/testify v1.6.1 // indirect
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
 	gopkg.in/square/go-jose.v2 v2.5.1
+	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/apimachinery v0.19.2
 )
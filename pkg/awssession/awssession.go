@@ -0,0 +1,173 @@
+package awssession
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+// eventualError is an error an API call can return while IAM has not yet
+// propagated a resource that was just created.
+type eventualError struct {
+	code string
+	// message, if set, must be part of the error message.
+	message string
+}
+
+// eventuallyConsistent lists the eventual consistency errors to retry, by
+// operation.
+var eventuallyConsistent = map[string][]eventualError{
+	// A role or OIDC provider that was just created is not visible yet.
+	"CreateRole":                 {{code: "MalformedPolicyDocument", message: "Invalid principal"}},
+	"UpdateAssumeRolePolicy":     {{code: "NoSuchEntity"}, {code: "MalformedPolicyDocument", message: "Invalid principal"}},
+	"PutRolePolicy":              {{code: "NoSuchEntity"}},
+	"AttachRolePolicy":           {{code: "NoSuchEntity"}},
+	"TagRole":                    {{code: "NoSuchEntity"}},
+	"UpdateRole":                 {{code: "NoSuchEntity"}},
+	"PutRolePermissionsBoundary": {{code: "NoSuchEntity"}},
+	// AssumeRoleWithWebIdentity is left out: its errors for a role that is
+	// not visible to STS yet are the same as for a wrong token or role, so
+	// only create --wait, which knows the role was just created, polls it.
+}
+
+const (
+	// throttledInterval is the gap between requests after the first
+	// throttling error, doubled on every further one up to
+	// maxThrottledInterval.
+	throttledInterval    = 100 * time.Millisecond
+	maxThrottledInterval = 5 * time.Second
+)
+
+// limiter spaces out the requests of a session. The gap between requests
+// widens on throttling errors and narrows again as requests succeed, so that
+// concurrent callers settle below the API rate limit.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *limiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+func (l *limiter) throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.interval *= 2
+	if l.interval < throttledInterval {
+		l.interval = throttledInterval
+	}
+	if l.interval > maxThrottledInterval {
+		l.interval = maxThrottledInterval
+	}
+	log.Printf("Throttled by AWS, spacing requests %s apart", l.interval)
+}
+
+func (l *limiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.interval = l.interval * 9 / 10
+	if l.interval < time.Millisecond {
+		l.interval = 0
+	}
+}
+
+// retryer retries eventual consistency errors on top of what the SDK
+// retries, backing off exponentially for up to about a minute.
+type retryer struct {
+	client.DefaultRetryer
+	limiter *limiter
+}
+
+func (r retryer) ShouldRetry(req *request.Request) bool {
+	if req.IsErrorThrottle() {
+		r.limiter.throttled()
+	}
+	if aerr, ok := req.Error.(awserr.Error); ok && req.Operation != nil {
+		for _, eventual := range eventuallyConsistent[req.Operation.Name] {
+			if aerr.Code() == eventual.code && strings.Contains(aerr.Message(), eventual.message) {
+				log.Printf("%s failed with %s, retrying until IAM catches up", req.Operation.Name, aerr.Code())
+				return true
+			}
+		}
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+// New returns a session for the region of the config, using its credential
+// source, endpoint overrides and CA bundle, that retries eventual consistency errors and rate limits its
+// requests when AWS throttles them. Clients made from the session share the
+// rate limit.
+func New(config create.Config) (*session.Session, error) {
+	// STS is called in the region, so that it works the same in every
+	// partition and in restricted networks.
+	cfg := &awssdk.Config{STSRegionalEndpoint: endpoints.RegionalSTSEndpoint}
+	if config.Region != "" {
+		cfg.Region = awssdk.String(config.Region)
+	}
+	if overrides := endpointOverrides(config); len(overrides) > 0 {
+		cfg.EndpointResolver = endpointResolver(overrides)
+		// Emulators serve every bucket from the one endpoint.
+		if _, ok := overrides[s3.EndpointsID]; ok {
+			cfg.S3ForcePathStyle = awssdk.Bool(true)
+		}
+	}
+	if config.CABundle != "" {
+		roots, err := RootCAs(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HTTPClient = httpClient(roots)
+	}
+	rateLimiter := &limiter{}
+	cfg = request.WithRetryer(cfg, retryer{
+		limiter: rateLimiter,
+		DefaultRetryer: client.DefaultRetryer{
+			NumMaxRetries:    8,
+			MinRetryDelay:    500 * time.Millisecond,
+			MaxRetryDelay:    15 * time.Second,
+			MinThrottleDelay: 500 * time.Millisecond,
+			MaxThrottleDelay: 30 * time.Second,
+		},
+	})
+
+	s, err := session.NewSessionWithOptions(sessionOptions(config, cfg))
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRoleARN != "" {
+		s = s.Copy(&awssdk.Config{Credentials: assumeRoleCredentials(s, config)})
+	}
+	s.Handlers.Send.PushFront(func(req *request.Request) {
+		rateLimiter.wait()
+	})
+	s.Handlers.Complete.PushBack(func(req *request.Request) {
+		if req.Error == nil {
+			rateLimiter.succeeded()
+		}
+	})
+	return s, nil
+}
@@ -0,0 +1,65 @@
+package awssession
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+// roleSessionName names the sessions of the admin role.
+const roleSessionName = "sts-preflight"
+
+// assumedRoles caches the admin role credentials by config, so that the
+// sessions of one run share them and ask for an MFA code only once.
+var (
+	assumedRolesMu sync.Mutex
+	assumedRoles   = map[string]*credentials.Credentials{}
+)
+
+// sessionOptions loads the shared config, for the profile of the config if
+// it names one, from the shared config file of the config instead of
+// ~/.aws/config if it names one. MFA codes for profiles that need them are
+// read from stdin.
+func sessionOptions(config create.Config, cfg *aws.Config) session.Options {
+	opts := session.Options{
+		Config:                  *cfg,
+		Profile:                 config.Profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+	if config.SharedConfigFile != "" {
+		opts.SharedConfigFiles = []string{defaults.SharedCredentialsFilename(), config.SharedConfigFile}
+	}
+	return opts
+}
+
+// assumeRoleCredentials returns credentials of the admin role of the config,
+// assumed with the credentials of the session and refreshed as they expire.
+func assumeRoleCredentials(s *session.Session, config create.Config) *credentials.Credentials {
+	key := strings.Join([]string{config.Profile, config.SharedConfigFile, config.AssumeRoleARN, config.ExternalID, config.MFASerial}, "|")
+	assumedRolesMu.Lock()
+	defer assumedRolesMu.Unlock()
+	if creds, ok := assumedRoles[key]; ok {
+		return creds
+	}
+
+	creds := stscreds.NewCredentials(s, config.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = roleSessionName
+		if config.ExternalID != "" {
+			p.ExternalID = aws.String(config.ExternalID)
+		}
+		if config.MFASerial != "" {
+			p.SerialNumber = aws.String(config.MFASerial)
+			p.TokenProvider = stscreds.StdinTokenProvider
+		}
+	})
+	assumedRoles[key] = creds
+	return creds
+}
@@ -0,0 +1,41 @@
+package awssession
+
+import (
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+// endpointOverrides returns the endpoint URL of each service the config
+// overrides, by endpoints ID. EndpointURL applies to the services without
+// an endpoint URL of their own.
+func endpointOverrides(config create.Config) map[string]string {
+	overrides := map[string]string{}
+	for id, url := range map[string]string{
+		s3.EndpointsID:  config.S3EndpointURL,
+		iam.EndpointsID: config.IAMEndpointURL,
+		sts.EndpointsID: config.STSEndpointURL,
+	} {
+		if url == "" {
+			url = config.EndpointURL
+		}
+		if url != "" {
+			overrides[id] = url
+		}
+	}
+	return overrides
+}
+
+// endpointResolver resolves the overridden services to their endpoint URL,
+// signed for the region, and the others as usual.
+func endpointResolver(overrides map[string]string) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if url, ok := overrides[service]; ok {
+			return endpoints.ResolvedEndpoint{URL: url, SigningRegion: region}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
@@ -0,0 +1,49 @@
+package awssession
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// usEast1 is the only region where S3 buckets are created without a
+// location constraint.
+const usEast1 = "us-east-1"
+
+// ValidateRegion fails for regions that are in no known partition.
+func ValidateRegion(region string) error {
+	if _, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); !ok {
+		return fmt.Errorf("region %q is not in a known AWS partition", region)
+	}
+	return nil
+}
+
+// Partition returns the partition of the region, such as aws, aws-cn or
+// aws-us-gov. Regions that ValidateRegion rejects are taken to be in aws.
+func Partition(region string) endpoints.Partition {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p
+	}
+	return endpoints.AwsPartition()
+}
+
+// S3Host returns the regional S3 host name of the region, such as
+// s3.cn-north-1.amazonaws.com.cn.
+func S3Host(region string) string {
+	return fmt.Sprintf("s3.%s.%s", region, Partition(region).DNSSuffix())
+}
+
+// AWSManagedPolicyARN returns the ARN of the AWS managed policy in the
+// partition of the region.
+func AWSManagedPolicyARN(region, name string) string {
+	return fmt.Sprintf("arn:%s:iam::aws:policy/%s", Partition(region).ID(), name)
+}
+
+// BucketLocationConstraint returns the location constraint to create a
+// bucket in the region with, which must be empty in us-east-1.
+func BucketLocationConstraint(region string) string {
+	if region == usEast1 {
+		return ""
+	}
+	return region
+}
@@ -0,0 +1,37 @@
+package awssession
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// RootCAs returns the system roots plus the certificates in caBundleFile,
+// such as the CA of a proxy that intercepts TLS.
+func RootCAs(caBundleFile string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if caBundleFile == "" {
+		return roots, nil
+	}
+	bundle, err := ioutil.ReadFile(caBundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %s", err)
+	}
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("CA bundle %s holds no PEM certificates", caBundleFile)
+	}
+	return roots, nil
+}
+
+// httpClient returns a client that goes through the proxy of the
+// HTTPS_PROXY and NO_PROXY environment and trusts the roots.
+func httpClient(roots *x509.CertPool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	return &http.Client{Transport: transport}
+}
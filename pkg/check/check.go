@@ -0,0 +1,485 @@
+package check
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/iamroles"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
+	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
+)
+
+const (
+	StatusPass = "pass"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+
+	// oidcProviderQuota is the default IAM quota on OIDC providers per
+	// account. Accounts can have a raised quota, so exceeding it only warns.
+	oidcProviderQuota = 100
+)
+
+var validBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+
+// Result is the outcome of one check.
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Details explain the outcome.
+	Details []string `json:"details,omitempty"`
+}
+
+// Report lists the outcome of every check.
+type Report struct {
+	Passed  bool     `json:"passed"`
+	Results []Result `json:"results"`
+}
+
+// Print writes the report in human readable form.
+func (r Report) Print(w io.Writer) {
+	counts := map[string]int{}
+	for _, result := range r.Results {
+		counts[result.Status]++
+		fmt.Fprintf(w, "%s: %s\n", result.Name, result.Status)
+		for _, detail := range result.Details {
+			fmt.Fprintf(w, "  %s\n", detail)
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d warnings, %d failed\n", counts[StatusPass], counts[StatusWarn], counts[StatusFail])
+}
+
+// PrintJSON writes the report as JSON.
+func (r Report) PrintJSON(w io.Writer) {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal check report: %s", err)
+	}
+	fmt.Fprintln(w, string(b))
+}
+
+type checker struct {
+	config    create.Config
+	s3Client  *s3.S3
+	iamClient *iam.IAM
+	partition string
+	accountID string
+	callerARN string
+	report    Report
+}
+
+// Run checks that create can be run with the config: that the names it
+// derives from the infra name are valid, that the bucket is free, that the
+// caller is allowed to make the calls create makes and that the account has
+// room for the OIDC provider and roles. Nothing is changed.
+func Run(config create.Config, crs []credreqs.CredentialsRequest, sas []podidentity.ServiceAccountRole) Report {
+	s, err := awssession.New(config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	identity, err := sts.New(s).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	callerARN, err := arn.Parse(awssdk.StringValue(identity.Arn))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	c := &checker{
+		config:    config,
+		s3Client:  s3.New(s),
+		iamClient: iam.New(s),
+		partition: callerARN.Partition,
+		accountID: awssdk.StringValue(identity.Account),
+		callerARN: callerARN.String(),
+		report:    Report{Passed: true},
+	}
+
+	issuerURL := s3endpoint.IssuerURL(config)
+	providerARN := c.iamARN("oidc-provider/" + issuerURL)
+	roles, roleErr := desiredRoles(config, crs, sas, providerARN, issuerURL)
+	roles = c.adoptLegacyRoleNames(roles)
+
+	c.names(roles, roleErr)
+	if config.ExternalIssuerURL == "" {
+		c.bucket(s3endpoint.BucketName(config))
+	}
+	c.permissions(roles, providerARN)
+	c.oidcProviderQuota(providerARN)
+	c.roleQuota(roles)
+
+	return c.report
+}
+
+func (c *checker) add(result Result) {
+	if result.Status == StatusFail {
+		c.report.Passed = false
+	}
+	c.report.Results = append(c.report.Results, result)
+}
+
+func (c *checker) iamARN(resource string) string {
+	return fmt.Sprintf("arn:%s:iam::%s:%s", c.partition, c.accountID, resource)
+}
+
+func (c *checker) roleARN(roleName string) string {
+	return c.iamARN("role" + c.config.RolePath + roleName)
+}
+
+// desiredRoles returns the roles for the CredentialsRequests and
+// ServiceAccounts, or the reason their names cannot be rendered.
+func desiredRoles(config create.Config, crs []credreqs.CredentialsRequest, sas []podidentity.ServiceAccountRole, providerARN, issuerURL string) (roles []iamroles.Role, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	roles = iamroles.DesiredRoles(config, crs, providerARN, issuerURL)
+	roles = append(roles, iamroles.ServiceAccountRoles(config, sas, providerARN, issuerURL)...)
+	return roles, nil
+}
+
+// adoptLegacyRoleNames returns the roles under the names create would use
+// for them, or unchanged if the roles cannot be looked up, which the
+// permission and quota checks then report.
+func (c *checker) adoptLegacyRoleNames(roles []iamroles.Role) (adopted []iamroles.Role) {
+	defer func() {
+		if r := recover(); r != nil {
+			adopted = roles
+		}
+	}()
+	return iamroles.AdoptLegacyRoleNames(c.iamClient, roles)
+}
+
+// names checks the bucket and role names derived from the infra name against
+// the S3 and IAM naming rules.
+func (c *checker) names(roles []iamroles.Role, roleErr error) {
+	result := Result{Name: "Names", Status: StatusPass}
+	fail := func(format string, args ...interface{}) {
+		result.Status = StatusFail
+		result.Details = append(result.Details, fmt.Sprintf(format, args...))
+	}
+
+	if c.config.ExternalIssuerURL == "" {
+		bucketName := s3endpoint.BucketName(c.config)
+		switch {
+		case len(bucketName) < 3 || len(bucketName) > 63:
+			fail("bucket name %s must be 3 to 63 characters long, shorten --infra-name", bucketName)
+		case !validBucketName.MatchString(bucketName):
+			fail("bucket name %s may only hold lowercase letters, digits, dots and hyphens, and must begin and end with a letter or digit", bucketName)
+		case strings.Contains(bucketName, ".."):
+			fail("bucket name %s must not hold two adjacent dots", bucketName)
+		case net.ParseIP(bucketName) != nil:
+			fail("bucket name %s must not be formatted as an IP address", bucketName)
+		case strings.HasPrefix(bucketName, "xn--") || strings.HasPrefix(bucketName, "sthree-"):
+			fail("bucket name %s must not begin with a reserved prefix", bucketName)
+		}
+	}
+
+	installerRoleName := s3endpoint.InstallerRoleName(c.config)
+	if !iamroles.ValidRoleName(installerRoleName) {
+		fail("installer role name %s must be at most 64 letters, digits and +=,.@_- characters, shorten --infra-name", installerRoleName)
+	}
+	if roleErr != nil {
+		fail("%s", roleErr)
+	} else if len(roles) > 0 {
+		result.Details = append(result.Details, fmt.Sprintf("%d role names rendered from --role-name-template", len(roles)))
+	}
+
+	c.add(result)
+}
+
+// bucket checks that the bucket either does not exist yet or belongs to the
+// account.
+func (c *checker) bucket(bucketName string) {
+	result := Result{Name: "Bucket", Status: StatusPass}
+
+	// S3 answers Forbidden for a bucket of another account, even one that
+	// grants the caller access.
+	_, err := c.s3Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket:              awssdk.String(bucketName),
+		ExpectedBucketOwner: awssdk.String(c.accountID),
+	})
+	if err == nil {
+		result.Details = append(result.Details, fmt.Sprintf("bucket %s exists in the account and will be reused", bucketName))
+		c.add(result)
+		return
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		log.Fatal(err.Error())
+	}
+	switch aerr.Code() {
+	case "NotFound", s3.ErrCodeNoSuchBucket:
+		result.Details = append(result.Details, fmt.Sprintf("bucket %s is available", bucketName))
+	case "Forbidden":
+		result.Status = StatusFail
+		result.Details = append(result.Details, fmt.Sprintf("bucket %s exists and is owned by another account, choose another --infra-name", bucketName))
+	default:
+		result.Status = StatusFail
+		result.Details = append(result.Details, fmt.Sprintf("bucket %s cannot be checked: %s", bucketName, err))
+	}
+	c.add(result)
+}
+
+// simulation is a set of actions create performs on a set of resources.
+type simulation struct {
+	actions   []string
+	resources []string
+}
+
+// permissions simulates the policies of the caller for the calls create
+// makes. Session policies and resource policies are not taken into account.
+func (c *checker) permissions(roles []iamroles.Role, providerARN string) {
+	result := Result{Name: "Permissions", Status: StatusPass}
+
+	source, err := c.policySource()
+	if err != nil {
+		result.Status = StatusWarn
+		result.Details = append(result.Details, err.Error())
+		c.add(result)
+		return
+	}
+	if source == "" {
+		result.Details = append(result.Details, fmt.Sprintf("%s is the account root user, which is not limited by IAM policies", c.callerARN))
+		c.add(result)
+		return
+	}
+
+	denied := 0
+	for _, sim := range c.simulations(roles, providerARN) {
+		err := c.iamClient.SimulatePrincipalPolicyPages(&iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: awssdk.String(source),
+			ActionNames:     awssdk.StringSlice(sim.actions),
+			ResourceArns:    awssdk.StringSlice(sim.resources),
+		}, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+			for _, eval := range page.EvaluationResults {
+				if awssdk.StringValue(eval.EvalDecision) == iam.PolicyEvaluationDecisionTypeAllowed {
+					continue
+				}
+				denied++
+				result.Details = append(result.Details, fmt.Sprintf("%s on %s: %s",
+					awssdk.StringValue(eval.EvalActionName), awssdk.StringValue(eval.EvalResourceName), awssdk.StringValue(eval.EvalDecision)))
+			}
+			return true
+		})
+		if err != nil {
+			result.Status = StatusWarn
+			result.Details = append(result.Details, fmt.Sprintf("cannot simulate the policies of %s: %s", source, err))
+			c.add(result)
+			return
+		}
+	}
+
+	if denied > 0 {
+		result.Status = StatusFail
+	} else {
+		result.Details = append(result.Details, fmt.Sprintf("%s is allowed every action create performs", source))
+	}
+	c.add(result)
+}
+
+// policySource returns the IAM user or role whose policies apply to the
+// caller, or "" for the root user.
+func (c *checker) policySource() (string, error) {
+	callerARN, _ := arn.Parse(c.callerARN)
+	switch {
+	case callerARN.Service == "iam" && callerARN.Resource == "root":
+		return "", nil
+	case callerARN.Service == "iam" && strings.HasPrefix(callerARN.Resource, "user/"):
+		return c.callerARN, nil
+	case callerARN.Service == "sts" && strings.HasPrefix(callerARN.Resource, "assumed-role/"):
+		// The session ARN omits the path of the role.
+		roleName := strings.Split(callerARN.Resource, "/")[1]
+		role, err := c.iamClient.GetRole(&iam.GetRoleInput{
+			RoleName: awssdk.String(roleName),
+		})
+		if err != nil {
+			return "", fmt.Errorf("cannot look up role %s of %s to simulate its policies: %s", roleName, c.callerARN, err)
+		}
+		return awssdk.StringValue(role.Role.Arn), nil
+	}
+	return "", fmt.Errorf("cannot simulate the policies of %s, only of IAM users and roles", c.callerARN)
+}
+
+// simulations returns the actions create performs, by the resources they are
+// performed on.
+func (c *checker) simulations(roles []iamroles.Role, providerARN string) []simulation {
+	roleARNs := []string{c.roleARN(s3endpoint.InstallerRoleName(c.config))}
+	policyARNs := []string{}
+	for _, role := range roles {
+		roleARNs = append(roleARNs, c.roleARN(role.Name))
+		_, managed := role.Policies()
+		for i := range managed {
+			policyARNs = append(policyARNs, c.iamARN("policy"+c.config.RolePath+iamroles.ManagedPolicyName(role.Name, i)))
+		}
+	}
+
+	roleActions := []string{
+		"iam:GetRole", "iam:CreateRole", "iam:UpdateRole", "iam:TagRole", "iam:UpdateAssumeRolePolicy",
+		"iam:GetRolePolicy", "iam:PutRolePolicy", "iam:DeleteRolePolicy",
+		"iam:ListAttachedRolePolicies", "iam:AttachRolePolicy", "iam:DetachRolePolicy",
+	}
+	if c.config.PermissionsBoundaryARN != "" {
+		roleActions = append(roleActions, "iam:PutRolePermissionsBoundary")
+	} else {
+		// create removes the boundary an earlier run set.
+		roleActions = append(roleActions, "iam:DeleteRolePermissionsBoundary")
+	}
+	sims := []simulation{
+		{
+			actions: []string{
+				"iam:ListOpenIDConnectProviders",
+			},
+			resources: []string{"*"},
+		},
+		{
+			actions: []string{
+				"iam:GetOpenIDConnectProvider", "iam:CreateOpenIDConnectProvider", "iam:TagOpenIDConnectProvider",
+				"iam:UpdateOpenIDConnectProviderThumbprint",
+				"iam:AddClientIDToOpenIDConnectProvider", "iam:RemoveClientIDFromOpenIDConnectProvider",
+			},
+			resources: []string{providerARN},
+		},
+		{actions: roleActions, resources: roleARNs},
+	}
+	if len(policyARNs) > 0 {
+		sims = append(sims, simulation{
+			actions: []string{
+				"iam:CreatePolicy", "iam:TagPolicy", "iam:GetPolicyVersion", "iam:ListPolicyVersions",
+				"iam:CreatePolicyVersion", "iam:DeletePolicyVersion",
+				"iam:ListEntitiesForPolicy", "iam:DeletePolicy",
+			},
+			resources: policyARNs,
+		})
+	}
+
+	if c.config.ExternalIssuerURL == "" {
+		bucketName := s3endpoint.BucketName(c.config)
+		bucketActions := []string{
+			// Without s3:ListBucket, HeadObject of a missing object is denied
+			// instead of not found.
+			"s3:CreateBucket", "s3:ListBucket", "s3:GetBucketTagging", "s3:PutBucketTagging",
+			"s3:GetBucketPublicAccessBlock", "s3:PutBucketPublicAccessBlock",
+			"s3:GetBucketOwnershipControls", "s3:PutBucketOwnershipControls",
+			"s3:GetBucketPolicy", "s3:PutBucketPolicy",
+		}
+		if c.config.BucketEncryption != "" {
+			bucketActions = append(bucketActions, "s3:GetEncryptionConfiguration", "s3:PutEncryptionConfiguration")
+		}
+		if c.config.BucketVersioning {
+			bucketActions = append(bucketActions, "s3:GetBucketVersioning", "s3:PutBucketVersioning")
+		}
+		if c.config.BucketLoggingTarget != "" {
+			bucketActions = append(bucketActions, "s3:GetBucketLogging", "s3:PutBucketLogging")
+		}
+		if c.config.BucketNoncurrentVersionExpirationDays > 0 {
+			bucketActions = append(bucketActions, "s3:GetLifecycleConfiguration", "s3:PutLifecycleConfiguration")
+		}
+		sims = append(sims,
+			simulation{
+				actions:   bucketActions,
+				resources: []string{fmt.Sprintf("arn:%s:s3:::%s", c.partition, bucketName)},
+			},
+			simulation{
+				actions: []string{"s3:GetObject", "s3:PutObject"},
+				resources: []string{
+					fmt.Sprintf("arn:%s:s3:::%s/%s", c.partition, bucketName, s3endpoint.DiscoveryURI),
+					fmt.Sprintf("arn:%s:s3:::%s/%s", c.partition, bucketName, s3endpoint.KeysURI),
+				},
+			},
+		)
+	}
+	return sims
+}
+
+// oidcProviderQuota checks that the account has room for the OIDC provider
+// under the default quota, unless it exists already.
+func (c *checker) oidcProviderQuota(providerARN string) {
+	result := Result{Name: "OIDC provider quota", Status: StatusPass}
+
+	providers, err := c.iamClient.ListOpenIDConnectProviders(&iam.ListOpenIDConnectProvidersInput{})
+	if err != nil {
+		result.Status = StatusWarn
+		result.Details = append(result.Details, fmt.Sprintf("cannot list OIDC providers: %s", err))
+		c.add(result)
+		return
+	}
+
+	used := len(providers.OpenIDConnectProviderList)
+	for _, provider := range providers.OpenIDConnectProviderList {
+		if awssdk.StringValue(provider.Arn) == providerARN {
+			result.Details = append(result.Details, fmt.Sprintf("%d OIDC providers used, %s exists and will be reused", used, providerARN))
+			c.add(result)
+			return
+		}
+	}
+	result.Details = append(result.Details, fmt.Sprintf("%d OIDC providers used, create adds 1", used))
+	if used >= oidcProviderQuota {
+		result.Status = StatusWarn
+		result.Details = append(result.Details, fmt.Sprintf("the default quota is %d OIDC providers, create fails unless the quota of the account was raised", oidcProviderQuota))
+	}
+	c.add(result)
+}
+
+// roleQuota checks that the account has room for the roles that do not
+// exist yet.
+func (c *checker) roleQuota(roles []iamroles.Role) {
+	result := Result{Name: "Role quota", Status: StatusPass}
+	warn := func(err error) {
+		result.Status = StatusWarn
+		result.Details = append(result.Details, fmt.Sprintf("cannot check the role quota: %s", err))
+		c.add(result)
+	}
+
+	summary, err := c.iamClient.GetAccountSummary(&iam.GetAccountSummaryInput{})
+	if err != nil {
+		warn(err)
+		return
+	}
+	used := awssdk.Int64Value(summary.SummaryMap["Roles"])
+	quota := awssdk.Int64Value(summary.SummaryMap["RolesQuota"])
+
+	roleNames := []string{s3endpoint.InstallerRoleName(c.config)}
+	for _, role := range roles {
+		roleNames = append(roleNames, role.Name)
+	}
+	missing := int64(0)
+	for _, roleName := range roleNames {
+		_, err := c.iamClient.GetRole(&iam.GetRoleInput{
+			RoleName: awssdk.String(roleName),
+		})
+		if err != nil {
+			var aerr awserr.Error
+			if !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+				warn(err)
+				return
+			}
+			missing++
+		}
+	}
+
+	if used+missing > quota {
+		result.Status = StatusFail
+	}
+	result.Details = append(result.Details, fmt.Sprintf("%d of %d roles used, create adds %d", used, quota, missing))
+	c.add(result)
+}
@@ -4,18 +4,140 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
 const (
 	stateFile = "state.json"
+
+	// ServiceAccountTrustExplicit trusts only the ServiceAccounts listed in
+	// a CredentialsRequest's spec.serviceAccountNames.
+	ServiceAccountTrustExplicit = "explicit"
+	// ServiceAccountTrustWildcard trusts every ServiceAccount in the
+	// namespace of a CredentialsRequest's target Secret.
+	ServiceAccountTrustWildcard = "wildcard"
+
+	// DefaultRoleNameTemplate names CredentialsRequest roles after the
+	// infrastructure name and the target Secret.
+	DefaultRoleNameTemplate = "{{.InfraName}}-{{.SecretNamespace}}-{{.SecretName}}"
+
+	// InfraNameTagKey tags every created resource with the infrastructure
+	// name that owns it.
+	InfraNameTagKey = "sts-preflight/infra-name"
+
+	// TargetOpenShift writes the OpenShift manifests and the signing key
+	// where openshift-install expects it.
+	TargetOpenShift = "openshift"
+	// TargetKubernetes writes kube-apiserver flags and kubeadm and kind
+	// configurations instead.
+	TargetKubernetes = "kubernetes"
+
+	// BucketEncryptionSSES3 and BucketEncryptionSSEKMS set the default
+	// encryption of the issuer bucket to S3 or KMS managed keys.
+	BucketEncryptionSSES3  = "sse-s3"
+	BucketEncryptionSSEKMS = "sse-kms"
 )
 
 type Config struct {
-	InfraName               string
-	Region                  string
-	CredentialsRequestsFile string
-	TargetDir               string
+	InfraName string `json:"infraName"`
+	Region    string `json:"region"`
+	TargetDir string `json:"targetDir"`
+	// Target is the kind of cluster the issuer is for, TargetOpenShift or
+	// TargetKubernetes.
+	Target string `json:"target,omitempty"`
+	// ExternalIssuerURL is an existing OIDC issuer to trust instead of
+	// hosting one in an S3 bucket.
+	ExternalIssuerURL string `json:"externalIssuerURL,omitempty"`
+
+	CredentialsRequestsFiles   []string `json:"credentialsRequestsFiles,omitempty"`
+	CredentialsRequestsInclude []string `json:"credentialsRequestsInclude,omitempty"`
+	CredentialsRequestsExclude []string `json:"credentialsRequestsExclude,omitempty"`
+	FeatureSet                 string   `json:"featureSet,omitempty"`
+	Capabilities               []string `json:"capabilities,omitempty"`
+
+	ServiceAccountTrust string `json:"serviceAccountTrust"`
+	RoleNameTemplate    string `json:"roleNameTemplate"`
+
+	InstallerPolicyARNs       []string `json:"installerPolicyARNs,omitempty"`
+	InstallerInlinePolicyFile string   `json:"installerInlinePolicyFile,omitempty"`
+	InstallerFeatures         []string `json:"installerFeatures,omitempty"`
+
+	// Profile and SharedConfigFile select the credentials from the shared
+	// config, instead of the default profile and ~/.aws/config.
+	Profile          string `json:"profile,omitempty"`
+	SharedConfigFile string `json:"sharedConfigFile,omitempty"`
+	// AssumeRoleARN is an admin role to assume with those credentials and do
+	// everything as, with ExternalID and the MFA device MFASerial if the
+	// role's trust policy requires them.
+	AssumeRoleARN string `json:"assumeRoleARN,omitempty"`
+	ExternalID    string `json:"externalID,omitempty"`
+	MFASerial     string `json:"mfaSerial,omitempty"`
+
+	// EndpointURL overrides the endpoint of S3, IAM and STS, such as for an
+	// emulator, unless the service has its own override. An S3 override
+	// makes requests use path-style addressing.
+	EndpointURL    string `json:"endpointURL,omitempty"`
+	S3EndpointURL  string `json:"s3EndpointURL,omitempty"`
+	IAMEndpointURL string `json:"iamEndpointURL,omitempty"`
+	STSEndpointURL string `json:"stsEndpointURL,omitempty"`
+	// CABundle holds certificates to trust besides the system roots for AWS
+	// and the issuer, such as the CA of a proxy that intercepts TLS.
+	// Proxies come from the HTTPS_PROXY and NO_PROXY environment.
+	CABundle string `json:"caBundle,omitempty"`
+
+	// BucketEncryption is the default encryption of the issuer bucket,
+	// BucketEncryptionSSES3 or BucketEncryptionSSEKMS, with BucketKMSKeyID
+	// or the AWS managed key.
+	BucketEncryption string `json:"bucketEncryption,omitempty"`
+	BucketKMSKeyID   string `json:"bucketKMSKeyID,omitempty"`
+	BucketVersioning bool   `json:"bucketVersioning,omitempty"`
+	// BucketLoggingTarget is the <bucket>[/<prefix>] the access logs of the
+	// issuer bucket go to.
+	BucketLoggingTarget string `json:"bucketLoggingTarget,omitempty"`
+	// BucketNoncurrentVersionExpirationDays adds a lifecycle rule expiring
+	// replaced versions of the issuer documents after that many days.
+	BucketNoncurrentVersionExpirationDays int64 `json:"bucketNoncurrentVersionExpirationDays,omitempty"`
+
+	Tags                   map[string]string `json:"tags,omitempty"`
+	RolePath               string            `json:"rolePath"`
+	PermissionsBoundaryARN string            `json:"permissionsBoundaryARN,omitempty"`
+	MaxSessionDuration     int64             `json:"maxSessionDuration"`
+
+	// Concurrency is the number of CredentialsRequest roles reconciled at
+	// the same time.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// STSRegionalEndpoints makes the credentials Secrets use the regional
+	// STS endpoint of Region.
+	STSRegionalEndpoints bool `json:"stsRegionalEndpoints"`
+	// AdditionalProfiles add profiles for the roles of other
+	// CredentialsRequests to credentials Secrets, as
+	// <namespace>/<name>:<profile>=<namespace>/<name>.
+	AdditionalProfiles []string `json:"additionalProfiles,omitempty"`
+
+	// ServiceAccountRolesFile lists ServiceAccounts outside the
+	// CredentialsRequest flow that get roles of their own, assumed through
+	// the pod identity webhook.
+	ServiceAccountRolesFile string `json:"serviceAccountRolesFile,omitempty"`
+	PodIdentityWebhookImage string `json:"podIdentityWebhookImage,omitempty"`
+
+	// InstallDir is the openshift-install directory to hand the manifests
+	// and signing key to.
+	InstallDir string `json:"installDir,omitempty"`
+}
+
+// ResourceTags returns the tags applied to every created resource, the user
+// supplied tags plus the infrastructure name ownership tag.
+func (c Config) ResourceTags() map[string]string {
+	tags := map[string]string{}
+	for k, v := range c.Tags {
+		tags[k] = v
+	}
+	tags[InfraNameTagKey] = c.InfraName
+	return tags
 }
 
 type State struct {
@@ -24,9 +146,92 @@ type State struct {
 	Kid       string `json:"kid"`
 	RoleARN   string `json:"roleARN"`
 	TargetDir string `json:"targetDir"`
+	// PolicyARNs are the customer managed policies created for roles whose
+	// policy exceeds the inline policy size limit.
+	PolicyARNs []string `json:"policyARNs,omitempty"`
+	// InstallerPolicyARNs are the managed policies create attached to the
+	// installer role, the only ones it detaches again.
+	InstallerPolicyARNs []string `json:"installerPolicyARNs,omitempty"`
+	// Config is the configuration of the last create, used by status to
+	// know what to expect.
+	Config *Config `json:"config,omitempty"`
+	// Journal lists the steps of an unfinished create, oldest first, so
+	// that they can be rolled back or resumed.
+	Journal []Step `json:"journal,omitempty"`
+
+	// run identifies the current run in the steps it records.
+	run string
+
+	// mu serializes updates from concurrently created roles.
+	mu sync.Mutex
+}
+
+// AddPolicyARN records a created customer managed policy.
+func (s *State) AddPolicyARN(policyARN string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.PolicyARNs {
+		if existing == policyARN {
+			return
+		}
+	}
+	s.PolicyARNs = append(s.PolicyARNs, policyARN)
+	sort.Strings(s.PolicyARNs)
+}
+
+// RemovePolicyARN forgets a deleted customer managed policy.
+func (s *State) RemovePolicyARN(policyARN string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policyARNs := []string{}
+	for _, existing := range s.PolicyARNs {
+		if existing != policyARN {
+			policyARNs = append(policyARNs, existing)
+		}
+	}
+	s.PolicyARNs = policyARNs
+}
+
+// AddInstallerPolicyARN records a managed policy attached to the installer
+// role.
+func (s *State) AddInstallerPolicyARN(policyARN string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.InstallerPolicyARNs {
+		if existing == policyARN {
+			return
+		}
+	}
+	s.InstallerPolicyARNs = append(s.InstallerPolicyARNs, policyARN)
+	sort.Strings(s.InstallerPolicyARNs)
+}
+
+// RemoveInstallerPolicyARN forgets a managed policy detached from the
+// installer role.
+func (s *State) RemoveInstallerPolicyARN(policyARN string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policyARNs := []string{}
+	for _, existing := range s.InstallerPolicyARNs {
+		if existing != policyARN {
+			policyARNs = append(policyARNs, existing)
+		}
+	}
+	s.InstallerPolicyARNs = policyARNs
 }
 
 func (s *State) Write() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.write()
+}
+
+func (s *State) write() {
 	jsonBytes, err := json.Marshal(s)
 	if err != nil {
 		log.Fatal(err)
@@ -39,6 +244,16 @@ func (s *State) Write() {
 	}
 }
 
+// ReadIfExists reads the state if a previous run wrote it, and reports
+// whether it did.
+func (s *State) ReadIfExists() bool {
+	if _, err := os.Stat(filepath.Join(s.TargetDir, stateFile)); os.IsNotExist(err) {
+		return false
+	}
+	s.Read()
+	return true
+}
+
 func (s *State) Read() {
 	stateFilePath := filepath.Join(s.TargetDir, stateFile)
 	jsonBytes, err := ioutil.ReadFile(stateFilePath)
@@ -0,0 +1,94 @@
+package create
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	KindBucket       = "Bucket"
+	KindObject       = "Object"
+	KindOIDCProvider = "OIDCProvider"
+	KindRole         = "Role"
+	KindPolicy       = "Policy"
+
+	StepCreated = "created"
+	StepUpdated = "updated"
+	StepDeleted = "deleted"
+)
+
+// Step is a change create made to one AWS resource. Objects are named
+// <bucket>/<key>, OIDC providers and policies by ARN and the others by name.
+// Run identifies the create that made the change, so that a resumed create
+// can tell its own steps from those of the runs it resumes.
+type Step struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Run    string `json:"run,omitempty"`
+}
+
+var interrupted int32
+
+// CatchInterrupts makes SIGINT and SIGTERM stop create at the next journaled
+// step instead of killing it halfway through one. A second signal kills it.
+// The returned func restores the default handling.
+func CatchInterrupts() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			log.Print("Interrupted, stopping after the current step")
+			atomic.StoreInt32(&interrupted, 1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// BeginRun starts a new run, which the steps recorded from now on belong to.
+func (s *State) BeginRun() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.run = time.Now().UTC().Format("20060102T150405.000000000Z")
+}
+
+// InRun reports whether the step was recorded by the current run.
+func (s *State) InRun(step Step) bool {
+	return s.run != "" && step.Run == s.run
+}
+
+// Record journals a step and writes the state, so that it survives a
+// failure later on. It panics if create was interrupted.
+func (s *State) Record(kind, name, action string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	step := Step{Kind: kind, Name: name, Action: action, Run: s.run}
+	found := false
+	for _, existing := range s.Journal {
+		if existing.Kind == step.Kind && existing.Name == step.Name && existing.Action == step.Action {
+			found = true
+			break
+		}
+	}
+	if !found {
+		s.Journal = append(s.Journal, step)
+	}
+	s.write()
+
+	if atomic.LoadInt32(&interrupted) == 1 {
+		log.Panic("Interrupted")
+	}
+}
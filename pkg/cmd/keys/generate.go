@@ -19,7 +19,7 @@ const (
 )
 
 func GenerateKeys(config Config) {
-	rsa.New(config.TargetDir)
+	rsa.New(config.TargetDir, true)
 
 	jwks.New(&create.State{}, config.TargetDir)
 
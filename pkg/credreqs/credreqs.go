@@ -0,0 +1,288 @@
+package credreqs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	credreqv1 "github.com/openshift/cloud-credential-operator/pkg/apis/cloudcredential/v1"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+const (
+	// FeatureSetAnnotation lists the cluster feature sets a release manifest
+	// is part of.
+	FeatureSetAnnotation = "release.openshift.io/feature-set"
+	// CapabilityAnnotation names the optional cluster capabilities, joined
+	// by '+', a release manifest belongs to.
+	CapabilityAnnotation = "capability.openshift.io/name"
+
+	// DefaultFeatureSet is the feature set of clusters that set none.
+	DefaultFeatureSet = "Default"
+	// NoCapabilities disables every optional capability when given as the
+	// only capability.
+	NoCapabilities = "None"
+)
+
+// CredentialsRequest is an AWS CredentialsRequest read from a manifest file.
+type CredentialsRequest struct {
+	*credreqv1.CredentialsRequest
+	// ServiceAccountNames are the ServiceAccounts that use the credentials.
+	ServiceAccountNames []string
+	// CloudTokenPath is where the ServiceAccount token is mounted.
+	CloudTokenPath  string
+	AWSProviderSpec credreqv1.AWSProviderSpec
+	// File is the manifest the CredentialsRequest was read from.
+	File string
+}
+
+// NamespacedName returns namespace/name of the CredentialsRequest.
+func (cr CredentialsRequest) NamespacedName() string {
+	return fmt.Sprintf("%s/%s", cr.Namespace, cr.Name)
+}
+
+// specFields holds CredentialsRequest spec fields that were added to the API
+// after the vendored cloud-credential-operator version.
+type specFields struct {
+	Spec struct {
+		ServiceAccountNames []string `json:"serviceAccountNames,omitempty"`
+		CloudTokenPath      string   `json:"cloudTokenPath,omitempty"`
+	} `json:"spec"`
+}
+
+// summary counts what happened to the documents read.
+type summary struct {
+	files       int
+	documents   int
+	aws         int
+	otherCloud  int
+	notCredReqs int
+	filtered    int
+}
+
+// Load reads the AWS CredentialsRequests from the files, directories and
+// globs in the config, applying the configured filters. The result is sorted
+// by namespace/name.
+func Load(createConfig create.Config) []CredentialsRequest {
+	files := expandPaths(createConfig.CredentialsRequestsFiles)
+
+	codec, err := credreqv1.NewCodec()
+	if err != nil {
+		log.Fatalf("Failed to create credReq codec: %s", err)
+	}
+
+	s := summary{files: len(files)}
+	crs := []CredentialsRequest{}
+	for _, file := range files {
+		crs = append(crs, loadFile(file, codec, createConfig, &s)...)
+	}
+
+	sort.Slice(crs, func(i, j int) bool {
+		return crs[i].NamespacedName() < crs[j].NamespacedName()
+	})
+	for i := 1; i < len(crs); i++ {
+		if crs[i].NamespacedName() == crs[i-1].NamespacedName() {
+			log.Fatalf("CredentialsRequest %s is defined twice, in %s and %s", crs[i].NamespacedName(), crs[i-1].File, crs[i].File)
+		}
+	}
+
+	log.Printf("Read %d documents from %d files: %d AWS CredentialsRequests, %d for other clouds, %d filtered out, %d not CredentialsRequests",
+		s.documents, s.files, s.aws, s.otherCloud, s.filtered, s.notCredReqs)
+
+	return crs
+}
+
+// expandPaths turns each path into a sorted list of manifest files. A path
+// may be a file, a directory whose .yaml, .yml and .json files are read, or a
+// glob.
+func expandPaths(paths []string) []string {
+	files := []string{}
+	seen := map[string]bool{}
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		switch {
+		case err == nil && info.IsDir():
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				log.Fatalf("Failed to read CredentialsRequests directory: %s", err)
+			}
+			for _, entry := range entries {
+				switch filepath.Ext(entry.Name()) {
+				case ".yaml", ".yml", ".json":
+					if !entry.IsDir() {
+						add(filepath.Join(p, entry.Name()))
+					}
+				}
+			}
+		case err == nil:
+			add(p)
+		case strings.ContainsAny(p, "*?["):
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				log.Fatalf("Invalid CredentialsRequests glob %q: %s", p, err)
+			}
+			if len(matches) == 0 {
+				log.Fatalf("CredentialsRequests glob %q matches no files", p)
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				add(match)
+			}
+		default:
+			log.Fatalf("Failed to open CredentialsRequests file: %s", err)
+		}
+	}
+
+	return files
+}
+
+func loadFile(file string, codec *credreqv1.ProviderCodec, createConfig create.Config, s *summary) []CredentialsRequest {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Failed to open CredentialsRequests file: %s", err)
+	}
+	defer f.Close()
+
+	crs := []CredentialsRequest{}
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Fatalf("Failed to decode %s: %s", file, err)
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		s.documents++
+
+		typeMeta := runtime.TypeMeta{}
+		if err := json.Unmarshal(raw, &typeMeta); err != nil {
+			log.Fatalf("Failed to decode %s: %s", file, err)
+		}
+		if typeMeta.Kind != "CredentialsRequest" {
+			s.notCredReqs++
+			continue
+		}
+
+		cr := &credreqv1.CredentialsRequest{}
+		if err := json.Unmarshal(raw, cr); err != nil {
+			log.Fatalf("Failed to decode CredentialsRequest in %s: %s", file, err)
+		}
+		fields := specFields{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			log.Fatalf("Failed to decode CredentialsRequest in %s: %s", file, err)
+		}
+
+		if cr.Spec.ProviderSpec == nil {
+			log.Fatalf("CredentialsRequest %s/%s in %s has no providerSpec", cr.Namespace, cr.Name, file)
+		}
+		providerMeta := runtime.TypeMeta{}
+		if err := json.Unmarshal(cr.Spec.ProviderSpec.Raw, &providerMeta); err != nil {
+			log.Fatalf("Failed to decode the provider spec of %s/%s in %s: %s", cr.Namespace, cr.Name, file, err)
+		}
+		if providerMeta.Kind != "AWSProviderSpec" {
+			s.otherCloud++
+			continue
+		}
+
+		if !included(cr, createConfig) {
+			log.Printf("CredentialsRequest %s/%s in %s filtered out", cr.Namespace, cr.Name, file)
+			s.filtered++
+			continue
+		}
+
+		awsProviderSpec := credreqv1.AWSProviderSpec{}
+		if err := codec.DecodeProviderSpec(cr.Spec.ProviderSpec, &awsProviderSpec); err != nil {
+			log.Fatalf("Failed to decode the provider spec of %s/%s in %s: %s", cr.Namespace, cr.Name, file, err)
+		}
+
+		s.aws++
+		crs = append(crs, CredentialsRequest{
+			CredentialsRequest:  cr,
+			ServiceAccountNames: fields.Spec.ServiceAccountNames,
+			CloudTokenPath:      fields.Spec.CloudTokenPath,
+			AWSProviderSpec:     awsProviderSpec,
+			File:                file,
+		})
+	}
+
+	return crs
+}
+
+// included applies the namespace/name and release annotation filters.
+func included(cr *credreqv1.CredentialsRequest, createConfig create.Config) bool {
+	namespacedName := fmt.Sprintf("%s/%s", cr.Namespace, cr.Name)
+
+	if len(createConfig.CredentialsRequestsInclude) > 0 && !matchesAny(createConfig.CredentialsRequestsInclude, namespacedName) {
+		return false
+	}
+	if matchesAny(createConfig.CredentialsRequestsExclude, namespacedName) {
+		return false
+	}
+
+	if featureSets, ok := cr.Annotations[FeatureSetAnnotation]; ok {
+		featureSet := createConfig.FeatureSet
+		if featureSet == "" {
+			featureSet = DefaultFeatureSet
+		}
+		if !containsString(strings.Split(featureSets, ","), featureSet) {
+			return false
+		}
+	}
+
+	if capabilities, ok := cr.Annotations[CapabilityAnnotation]; ok && len(createConfig.Capabilities) > 0 {
+		if len(createConfig.Capabilities) == 1 && strings.TrimSpace(createConfig.Capabilities[0]) == NoCapabilities {
+			return false
+		}
+		for _, capability := range strings.Split(capabilities, "+") {
+			if !containsString(createConfig.Capabilities, capability) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// matchesAny reports whether namespacedName matches any of the
+// namespace/name glob patterns.
+func matchesAny(patterns []string, namespacedName string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, namespacedName); err != nil {
+			log.Fatalf("Invalid CredentialsRequest filter %q: %s", pattern, err)
+		} else if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.TrimSpace(item) == s {
+			return true
+		}
+	}
+	return false
+}
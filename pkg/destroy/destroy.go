@@ -0,0 +1,156 @@
+package destroy
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/iamroles"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
+	"github.com/sjenning/sts-preflight/pkg/rollback"
+	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
+)
+
+// Run deletes the Roles, customer managed policies, OIDC provider and bucket
+// create made for the config. Resources that do not carry the infrastructure
+// name tag of the config were not made by create and are left alone. The
+// state is cleared of what was deleted, so that create starts over.
+func Run(config create.Config, state *create.State, crs []credreqs.CredentialsRequest, sas []podidentity.ServiceAccountRole) {
+	s, err := awssession.New(config)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	s3Client := s3.New(s)
+	iamClient := iam.New(s)
+
+	bucketName := s3endpoint.BucketName(config)
+	issuerURL := s3endpoint.IssuerURL(config)
+	providerARN := findOIDCProvider(iamClient, issuerURL)
+
+	roles := iamroles.AdoptLegacyRoleNames(iamClient, iamroles.DesiredRoles(config, crs, providerARN, issuerURL))
+	roles = append(roles, iamroles.ServiceAccountRoles(config, sas, providerARN, issuerURL)...)
+	roleNames := []string{}
+	for _, role := range roles {
+		roleNames = append(roleNames, role.Name)
+	}
+	roleNames = append(roleNames, s3endpoint.InstallerRoleName(config))
+
+	for _, roleName := range roleNames {
+		if role := getRole(iamClient, roleName); role == nil {
+			log.Printf("Role %s does not exist", roleName)
+		} else if ownedBy(config, role.Tags) {
+			rollback.DeleteRole(iamClient, roleName)
+		} else {
+			log.Printf("Role %s is not tagged %s=%s, leaving it", roleName, create.InfraNameTagKey, config.InfraName)
+		}
+	}
+	state.RoleARN = ""
+	state.InstallerPolicyARNs = nil
+
+	for _, policyARN := range state.PolicyARNs {
+		iamroles.DeleteManagedPolicy(iamClient, policyARN)
+		state.RemovePolicyARN(policyARN)
+	}
+
+	if providerARN == "" {
+		log.Printf("OIDC provider for %s does not exist", issuerURL)
+	} else {
+		provider, err := iamClient.GetOpenIDConnectProvider(&iam.GetOpenIDConnectProviderInput{
+			OpenIDConnectProviderArn: awssdk.String(providerARN),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		if ownedBy(config, provider.Tags) {
+			rollback.DeleteOIDCProvider(iamClient, providerARN)
+		} else {
+			log.Printf("OIDC provider %s is not tagged %s=%s, leaving it", providerARN, create.InfraNameTagKey, config.InfraName)
+		}
+	}
+
+	if config.ExternalIssuerURL == "" {
+		destroyBucket(s3Client, config, bucketName)
+	}
+
+	state.Journal = nil
+	state.Write()
+}
+
+// findOIDCProvider returns the ARN of the OIDC provider for the issuer, or ""
+// if there is none.
+func findOIDCProvider(iamClient *iam.IAM, issuerURL string) string {
+	providers, err := iamClient.ListOpenIDConnectProviders(&iam.ListOpenIDConnectProvidersInput{})
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	for _, provider := range providers.OpenIDConnectProviderList {
+		if strings.HasSuffix(awssdk.StringValue(provider.Arn), ":oidc-provider/"+issuerURL) {
+			return awssdk.StringValue(provider.Arn)
+		}
+	}
+	return ""
+}
+
+func getRole(iamClient *iam.IAM, roleName string) *iam.Role {
+	output, err := iamClient.GetRole(&iam.GetRoleInput{
+		RoleName: awssdk.String(roleName),
+	})
+	if err != nil {
+		if isCode(err, iam.ErrCodeNoSuchEntityException) {
+			return nil
+		}
+		log.Panic(err.Error())
+	}
+	return output.Role
+}
+
+// destroyBucket deletes the bucket with the documents in it, if it carries
+// the infrastructure name tag.
+func destroyBucket(s3Client *s3.S3, config create.Config, bucketName string) {
+	tagging, err := s3Client.GetBucketTagging(&s3.GetBucketTaggingInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		switch {
+		case isCode(err, s3.ErrCodeNoSuchBucket):
+			log.Printf("Bucket %s does not exist", bucketName)
+			return
+		case isCode(err, "NoSuchTagSet"):
+			tagging = &s3.GetBucketTaggingOutput{}
+		default:
+			log.Panic(err.Error())
+		}
+	}
+
+	for _, tag := range tagging.TagSet {
+		if awssdk.StringValue(tag.Key) == create.InfraNameTagKey && awssdk.StringValue(tag.Value) == config.InfraName {
+			rollback.DeleteBucket(s3Client, bucketName)
+			return
+		}
+	}
+	log.Printf("Bucket %s is not tagged %s=%s, leaving it", bucketName, create.InfraNameTagKey, config.InfraName)
+}
+
+// ownedBy reports whether the IAM tags hold the infrastructure name of the
+// config.
+func ownedBy(config create.Config, tags []*iam.Tag) bool {
+	for _, tag := range tags {
+		if awssdk.StringValue(tag.Key) == create.InfraNameTagKey && awssdk.StringValue(tag.Value) == config.InfraName {
+			return true
+		}
+	}
+	return false
+}
+
+func isCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
@@ -0,0 +1,216 @@
+// Package fakeaws is an in-process stand-in for the S3, IAM and STS APIs the
+// tool calls, for end-to-end tests against --endpoint-url. It keeps its
+// resources in memory and only implements the calls the tool makes.
+package fakeaws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AccountID is the account of the fake.
+	AccountID = "123456789012"
+
+	timeFormat = "2006-01-02T15:04:05Z"
+)
+
+// Server serves S3 with path-style addressing and the IAM and STS query
+// APIs from one endpoint.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	providers map[string]*oidcProvider
+	roles     map[string]*role
+	ids       int
+}
+
+// New starts a fake. Close it when done.
+func New() *Server {
+	s := &Server{
+		buckets:   map[string]*bucket{},
+		providers: map[string]*oidcProvider{},
+		roles:     map[string]*role{},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Buckets returns the names of the buckets the fake holds, sorted.
+func (s *Server) Buckets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OIDCProviders returns the ARNs of the OIDC providers the fake holds,
+// sorted.
+func (s *Server) OIDCProviders() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	arns := []string{}
+	for arn := range s.providers {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	return arns
+}
+
+// Roles returns the names of the roles the fake holds, sorted.
+func (s *Server) Roles() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	for name := range s.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method == http.MethodPost && r.URL.Path == "/" {
+		if err := r.ParseForm(); err != nil {
+			queryError(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+			return
+		}
+		action := r.PostForm.Get("Action")
+		if handler, ok := stsActions[action]; ok {
+			handler(s, w, r.PostForm)
+			return
+		}
+		if handler, ok := iamActions[action]; ok {
+			handler(s, w, r.PostForm)
+			return
+		}
+		queryError(w, http.StatusBadRequest, "InvalidAction", fmt.Sprintf("action %s is not implemented by the fake", action))
+		return
+	}
+	s.serveS3(w, r)
+}
+
+func (s *Server) nextID(prefix string) string {
+	s.ids++
+	return fmt.Sprintf("%s%016d", prefix, s.ids)
+}
+
+func now() string {
+	return time.Now().UTC().Format(timeFormat)
+}
+
+func md5Hex(b []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(b))
+}
+
+// queryResult writes the response of a query API action.
+func queryResult(w http.ResponseWriter, namespace, action string, result interface{}) {
+	if result == nil {
+		result = struct{}{}
+	}
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	start := xml.StartElement{
+		Name: xml.Name{Local: action + "Response"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: namespace}},
+	}
+	err := enc.EncodeToken(start)
+	if err == nil {
+		err = enc.EncodeElement(result, xml.StartElement{Name: xml.Name{Local: action + "Result"}})
+	}
+	if err == nil {
+		err = enc.EncodeElement(struct {
+			RequestID string `xml:"RequestId"`
+		}{"fake"}, xml.StartElement{Name: xml.Name{Local: "ResponseMetadata"}})
+	}
+	if err == nil {
+		err = enc.EncodeToken(start.End())
+	}
+	if err == nil {
+		err = enc.Flush()
+	}
+	if err != nil {
+		queryError(w, http.StatusInternalServerError, "InternalFailure", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf.Bytes())
+}
+
+// queryError writes an error of a query API action.
+func queryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>fake</RequestId></ErrorResponse>", code, xmlEscape(message))
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// members returns the values of a query API list parameter, such as
+// ClientIDList.member.1, in order.
+func members(form url.Values, name string) []string {
+	values := []string{}
+	for i := 1; ; i++ {
+		key := fmt.Sprintf("%s.member.%d", name, i)
+		if _, ok := form[key]; !ok {
+			return values
+		}
+		values = append(values, form.Get(key))
+	}
+}
+
+// tags returns the Tags.member.N.Key and Value parameters.
+func tags(form url.Values) map[string]string {
+	tags := map[string]string{}
+	for i := 1; ; i++ {
+		key := fmt.Sprintf("Tags.member.%d.Key", i)
+		if _, ok := form[key]; !ok {
+			return tags
+		}
+		tags[form.Get(key)] = form.Get(fmt.Sprintf("Tags.member.%d.Value", i))
+	}
+}
+
+// readBody returns the body of the request.
+func readBody(r *http.Request) []byte {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// splitPath splits a path-style S3 path into bucket and key.
+func splitPath(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
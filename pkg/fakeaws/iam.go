@@ -0,0 +1,473 @@
+package fakeaws
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const iamNamespace = "https://iam.amazonaws.com/doc/2010-05-08/"
+
+type iamTag struct {
+	Key   string
+	Value string
+}
+
+type oidcProvider struct {
+	url         string
+	clientIDs   []string
+	thumbprints []string
+	tags        map[string]string
+	created     string
+}
+
+type role struct {
+	name                string
+	id                  string
+	path                string
+	arn                 string
+	description         string
+	trustPolicy         string
+	maxSessionDuration  int64
+	permissionsBoundary string
+	tags                map[string]string
+	created             string
+	inlinePolicies      map[string]string
+	attachedPolicies    []string
+}
+
+// queryAction handles an action of the IAM or STS query API.
+type queryAction func(s *Server, w http.ResponseWriter, form url.Values)
+
+var iamActions = map[string]queryAction{
+	"ListOpenIDConnectProviders":              (*Server).listOpenIDConnectProviders,
+	"CreateOpenIDConnectProvider":             (*Server).createOpenIDConnectProvider,
+	"GetOpenIDConnectProvider":                (*Server).getOpenIDConnectProvider,
+	"DeleteOpenIDConnectProvider":             (*Server).deleteOpenIDConnectProvider,
+	"AddClientIDToOpenIDConnectProvider":      (*Server).addClientIDToOpenIDConnectProvider,
+	"RemoveClientIDFromOpenIDConnectProvider": (*Server).removeClientIDFromOpenIDConnectProvider,
+	"UpdateOpenIDConnectProviderThumbprint":   (*Server).updateOpenIDConnectProviderThumbprint,
+	"TagOpenIDConnectProvider":                (*Server).tagOpenIDConnectProvider,
+	"CreateRole":                              (*Server).createRole,
+	"GetRole":                                 (*Server).getRole,
+	"DeleteRole":                              (*Server).deleteRole,
+	"UpdateRole":                              (*Server).updateRole,
+	"UpdateAssumeRolePolicy":                  (*Server).updateAssumeRolePolicy,
+	"TagRole":                                 (*Server).tagRole,
+	"PutRolePermissionsBoundary":              (*Server).putRolePermissionsBoundary,
+	"DeleteRolePermissionsBoundary":           (*Server).deleteRolePermissionsBoundary,
+	"PutRolePolicy":                           (*Server).putRolePolicy,
+	"GetRolePolicy":                           (*Server).getRolePolicy,
+	"DeleteRolePolicy":                        (*Server).deleteRolePolicy,
+	"ListRolePolicies":                        (*Server).listRolePolicies,
+	"AttachRolePolicy":                        (*Server).attachRolePolicy,
+	"DetachRolePolicy":                        (*Server).detachRolePolicy,
+	"ListAttachedRolePolicies":                (*Server).listAttachedRolePolicies,
+}
+
+func sortedTags(tags map[string]string) []iamTag {
+	result := []iamTag{}
+	for k, v := range tags {
+		result = append(result, iamTag{Key: k, Value: v})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+func noSuchEntity(w http.ResponseWriter, what string) {
+	queryError(w, http.StatusNotFound, "NoSuchEntity", what+" cannot be found")
+}
+
+func (s *Server) provider(w http.ResponseWriter, form url.Values) *oidcProvider {
+	arn := form.Get("OpenIDConnectProviderArn")
+	provider, ok := s.providers[arn]
+	if !ok {
+		noSuchEntity(w, "OIDC provider "+arn)
+	}
+	return provider
+}
+
+func (s *Server) listOpenIDConnectProviders(w http.ResponseWriter, form url.Values) {
+	type entry struct {
+		Arn string
+	}
+	result := struct {
+		List []entry `xml:"OpenIDConnectProviderList>member"`
+	}{}
+	arns := []string{}
+	for arn := range s.providers {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	for _, arn := range arns {
+		result.List = append(result.List, entry{Arn: arn})
+	}
+	queryResult(w, iamNamespace, "ListOpenIDConnectProviders", result)
+}
+
+func (s *Server) createOpenIDConnectProvider(w http.ResponseWriter, form url.Values) {
+	providerURL := strings.TrimPrefix(form.Get("Url"), "https://")
+	arn := fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", AccountID, providerURL)
+	if _, ok := s.providers[arn]; ok {
+		queryError(w, http.StatusConflict, "EntityAlreadyExists", "OIDC provider "+arn+" already exists")
+		return
+	}
+	s.providers[arn] = &oidcProvider{
+		url:         providerURL,
+		clientIDs:   members(form, "ClientIDList"),
+		thumbprints: members(form, "ThumbprintList"),
+		tags:        tags(form),
+		created:     now(),
+	}
+	queryResult(w, iamNamespace, "CreateOpenIDConnectProvider", struct {
+		OpenIDConnectProviderArn string
+		Tags                     []iamTag `xml:"Tags>member"`
+	}{arn, sortedTags(s.providers[arn].tags)})
+}
+
+func (s *Server) getOpenIDConnectProvider(w http.ResponseWriter, form url.Values) {
+	provider := s.provider(w, form)
+	if provider == nil {
+		return
+	}
+	queryResult(w, iamNamespace, "GetOpenIDConnectProvider", struct {
+		Url            string
+		ClientIDList   []string `xml:"ClientIDList>member"`
+		ThumbprintList []string `xml:"ThumbprintList>member"`
+		CreateDate     string
+		Tags           []iamTag `xml:"Tags>member"`
+	}{provider.url, provider.clientIDs, provider.thumbprints, provider.created, sortedTags(provider.tags)})
+}
+
+func (s *Server) deleteOpenIDConnectProvider(w http.ResponseWriter, form url.Values) {
+	if s.provider(w, form) == nil {
+		return
+	}
+	delete(s.providers, form.Get("OpenIDConnectProviderArn"))
+	queryResult(w, iamNamespace, "DeleteOpenIDConnectProvider", nil)
+}
+
+func (s *Server) addClientIDToOpenIDConnectProvider(w http.ResponseWriter, form url.Values) {
+	provider := s.provider(w, form)
+	if provider == nil {
+		return
+	}
+	if !containsString(provider.clientIDs, form.Get("ClientID")) {
+		provider.clientIDs = append(provider.clientIDs, form.Get("ClientID"))
+	}
+	queryResult(w, iamNamespace, "AddClientIDToOpenIDConnectProvider", nil)
+}
+
+func (s *Server) removeClientIDFromOpenIDConnectProvider(w http.ResponseWriter, form url.Values) {
+	provider := s.provider(w, form)
+	if provider == nil {
+		return
+	}
+	provider.clientIDs = removeString(provider.clientIDs, form.Get("ClientID"))
+	queryResult(w, iamNamespace, "RemoveClientIDFromOpenIDConnectProvider", nil)
+}
+
+func (s *Server) updateOpenIDConnectProviderThumbprint(w http.ResponseWriter, form url.Values) {
+	provider := s.provider(w, form)
+	if provider == nil {
+		return
+	}
+	provider.thumbprints = members(form, "ThumbprintList")
+	queryResult(w, iamNamespace, "UpdateOpenIDConnectProviderThumbprint", nil)
+}
+
+func (s *Server) tagOpenIDConnectProvider(w http.ResponseWriter, form url.Values) {
+	provider := s.provider(w, form)
+	if provider == nil {
+		return
+	}
+	for k, v := range tags(form) {
+		provider.tags[k] = v
+	}
+	queryResult(w, iamNamespace, "TagOpenIDConnectProvider", nil)
+}
+
+func (s *Server) role(w http.ResponseWriter, form url.Values) *role {
+	name := form.Get("RoleName")
+	r, ok := s.roles[name]
+	if !ok {
+		noSuchEntity(w, "role "+name)
+	}
+	return r
+}
+
+// roleResult is a role as IAM returns it. Policy documents are URL encoded.
+type roleResult struct {
+	Path                     string
+	RoleName                 string
+	RoleId                   string
+	Arn                      string
+	CreateDate               string
+	AssumeRolePolicyDocument string
+	Description              string `xml:",omitempty"`
+	MaxSessionDuration       int64
+	PermissionsBoundary      *permissionsBoundary `xml:",omitempty"`
+	Tags                     []iamTag             `xml:"Tags>member"`
+}
+
+type permissionsBoundary struct {
+	PermissionsBoundaryType string
+	PermissionsBoundaryArn  string
+}
+
+func (r *role) result() roleResult {
+	result := roleResult{
+		Path:                     r.path,
+		RoleName:                 r.name,
+		RoleId:                   r.id,
+		Arn:                      r.arn,
+		CreateDate:               r.created,
+		AssumeRolePolicyDocument: url.QueryEscape(r.trustPolicy),
+		Description:              r.description,
+		MaxSessionDuration:       r.maxSessionDuration,
+		Tags:                     sortedTags(r.tags),
+	}
+	if r.permissionsBoundary != "" {
+		result.PermissionsBoundary = &permissionsBoundary{"Policy", r.permissionsBoundary}
+	}
+	return result
+}
+
+func (s *Server) createRole(w http.ResponseWriter, form url.Values) {
+	name := form.Get("RoleName")
+	if _, ok := s.roles[name]; ok {
+		queryError(w, http.StatusConflict, "EntityAlreadyExists", "role "+name+" already exists")
+		return
+	}
+	path := form.Get("Path")
+	if path == "" {
+		path = "/"
+	}
+	maxSessionDuration, err := strconv.ParseInt(form.Get("MaxSessionDuration"), 10, 64)
+	if err != nil {
+		maxSessionDuration = 3600
+	}
+	r := &role{
+		name:                name,
+		id:                  s.nextID("AROA"),
+		path:                path,
+		arn:                 fmt.Sprintf("arn:aws:iam::%s:role%s%s", AccountID, path, name),
+		description:         form.Get("Description"),
+		trustPolicy:         form.Get("AssumeRolePolicyDocument"),
+		maxSessionDuration:  maxSessionDuration,
+		permissionsBoundary: form.Get("PermissionsBoundary"),
+		tags:                tags(form),
+		created:             now(),
+		inlinePolicies:      map[string]string{},
+	}
+	s.roles[name] = r
+	queryResult(w, iamNamespace, "CreateRole", struct {
+		Role roleResult
+	}{r.result()})
+}
+
+func (s *Server) getRole(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	queryResult(w, iamNamespace, "GetRole", struct {
+		Role roleResult
+	}{r.result()})
+}
+
+// deleteRole fails like IAM while the role still has policies.
+func (s *Server) deleteRole(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	if len(r.inlinePolicies) > 0 || len(r.attachedPolicies) > 0 {
+		queryError(w, http.StatusConflict, "DeleteConflict", "role "+r.name+" still has policies")
+		return
+	}
+	delete(s.roles, r.name)
+	queryResult(w, iamNamespace, "DeleteRole", nil)
+}
+
+func (s *Server) updateRole(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	if value := form.Get("MaxSessionDuration"); value != "" {
+		maxSessionDuration, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			queryError(w, http.StatusBadRequest, "ValidationError", err.Error())
+			return
+		}
+		r.maxSessionDuration = maxSessionDuration
+	}
+	if _, ok := form["Description"]; ok {
+		r.description = form.Get("Description")
+	}
+	queryResult(w, iamNamespace, "UpdateRole", nil)
+}
+
+func (s *Server) updateAssumeRolePolicy(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	r.trustPolicy = form.Get("PolicyDocument")
+	queryResult(w, iamNamespace, "UpdateAssumeRolePolicy", nil)
+}
+
+func (s *Server) tagRole(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	for k, v := range tags(form) {
+		r.tags[k] = v
+	}
+	queryResult(w, iamNamespace, "TagRole", nil)
+}
+
+func (s *Server) putRolePermissionsBoundary(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	r.permissionsBoundary = form.Get("PermissionsBoundary")
+	queryResult(w, iamNamespace, "PutRolePermissionsBoundary", nil)
+}
+
+func (s *Server) deleteRolePermissionsBoundary(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	r.permissionsBoundary = ""
+	queryResult(w, iamNamespace, "DeleteRolePermissionsBoundary", nil)
+}
+
+func (s *Server) putRolePolicy(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	r.inlinePolicies[form.Get("PolicyName")] = form.Get("PolicyDocument")
+	queryResult(w, iamNamespace, "PutRolePolicy", nil)
+}
+
+func (s *Server) getRolePolicy(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	policyName := form.Get("PolicyName")
+	document, ok := r.inlinePolicies[policyName]
+	if !ok {
+		noSuchEntity(w, "policy "+policyName+" of role "+r.name)
+		return
+	}
+	queryResult(w, iamNamespace, "GetRolePolicy", struct {
+		RoleName       string
+		PolicyName     string
+		PolicyDocument string
+	}{r.name, policyName, url.QueryEscape(document)})
+}
+
+func (s *Server) deleteRolePolicy(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	policyName := form.Get("PolicyName")
+	if _, ok := r.inlinePolicies[policyName]; !ok {
+		noSuchEntity(w, "policy "+policyName+" of role "+r.name)
+		return
+	}
+	delete(r.inlinePolicies, policyName)
+	queryResult(w, iamNamespace, "DeleteRolePolicy", nil)
+}
+
+func (s *Server) listRolePolicies(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	result := struct {
+		PolicyNames []string `xml:"PolicyNames>member"`
+		IsTruncated bool
+	}{}
+	for policyName := range r.inlinePolicies {
+		result.PolicyNames = append(result.PolicyNames, policyName)
+	}
+	sort.Strings(result.PolicyNames)
+	queryResult(w, iamNamespace, "ListRolePolicies", result)
+}
+
+func (s *Server) attachRolePolicy(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	if !containsString(r.attachedPolicies, form.Get("PolicyArn")) {
+		r.attachedPolicies = append(r.attachedPolicies, form.Get("PolicyArn"))
+	}
+	queryResult(w, iamNamespace, "AttachRolePolicy", nil)
+}
+
+func (s *Server) detachRolePolicy(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	if !containsString(r.attachedPolicies, form.Get("PolicyArn")) {
+		noSuchEntity(w, "attached policy "+form.Get("PolicyArn"))
+		return
+	}
+	r.attachedPolicies = removeString(r.attachedPolicies, form.Get("PolicyArn"))
+	queryResult(w, iamNamespace, "DetachRolePolicy", nil)
+}
+
+func (s *Server) listAttachedRolePolicies(w http.ResponseWriter, form url.Values) {
+	r := s.role(w, form)
+	if r == nil {
+		return
+	}
+	type attachedPolicy struct {
+		PolicyName string
+		PolicyArn  string
+	}
+	result := struct {
+		AttachedPolicies []attachedPolicy `xml:"AttachedPolicies>member"`
+		IsTruncated      bool
+	}{}
+	for _, policyARN := range r.attachedPolicies {
+		result.AttachedPolicies = append(result.AttachedPolicies, attachedPolicy{
+			PolicyName: policyARN[strings.LastIndex(policyARN, "/")+1:],
+			PolicyArn:  policyARN,
+		})
+	}
+	queryResult(w, iamNamespace, "ListAttachedRolePolicies", result)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	result := []string{}
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,215 @@
+package fakeaws
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+type object struct {
+	body         []byte
+	contentType  string
+	cacheControl string
+}
+
+type bucket struct {
+	objects map[string]object
+	// subresources holds the bodies put for bucket settings such as tagging
+	// or policy, which are served back as they are.
+	subresources map[string][]byte
+}
+
+// bucketSubresources are the bucket settings the fake stores, with the
+// error code S3 returns for a bucket without them. Versioning and logging
+// are served empty instead.
+var bucketSubresources = map[string]string{
+	"tagging":           "NoSuchTagSet",
+	"policy":            "NoSuchBucketPolicy",
+	"publicAccessBlock": "NoSuchPublicAccessBlockConfiguration",
+	"ownershipControls": "OwnershipControlsNotFoundError",
+	"encryption":        "ServerSideEncryptionConfigurationNotFoundError",
+	"lifecycle":         "NoSuchLifecycleConfiguration",
+	"versioning":        "",
+	"logging":           "",
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.WriteHeader(status)
+	// HEAD responses have no body, so the SDK takes the code from the status.
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, xmlEscape(message))
+}
+
+func s3Result(w http.ResponseWriter, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(body)
+}
+
+func (s *Server) serveS3(w http.ResponseWriter, r *http.Request) {
+	bucketName, key := splitPath(r.URL.Path)
+	if bucketName == "" {
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented", "listing buckets is not implemented by the fake")
+		return
+	}
+
+	b, exists := s.buckets[bucketName]
+	if r.Method == http.MethodPut && key == "" && len(r.URL.Query()) == 0 {
+		if exists {
+			s3Error(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou", "bucket already exists")
+			return
+		}
+		s.buckets[bucketName] = &bucket{objects: map[string]object{}, subresources: map[string][]byte{}}
+		return
+	}
+	if !exists {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket", "bucket does not exist")
+		return
+	}
+	if owner := r.Header.Get("X-Amz-Expected-Bucket-Owner"); owner != "" && owner != AccountID {
+		s3Error(w, r, http.StatusForbidden, "AccessDenied", "bucket is owned by another account")
+		return
+	}
+
+	if key != "" {
+		s.serveObject(w, r, b, key)
+		return
+	}
+
+	query := r.URL.Query()
+	for subresource, notFound := range bucketSubresources {
+		if _, ok := query[subresource]; !ok {
+			continue
+		}
+		switch r.Method {
+		case http.MethodPut:
+			b.subresources[subresource] = readBody(r)
+		case http.MethodDelete:
+			delete(b.subresources, subresource)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			body, ok := b.subresources[subresource]
+			switch {
+			case ok:
+				w.Write(body)
+			case notFound != "":
+				s3Error(w, r, http.StatusNotFound, notFound, subresource+" is not set")
+			default:
+				w.Write([]byte("<Empty/>"))
+			}
+		}
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+	case r.Method == http.MethodGet && hasParam(r, "versions"):
+		s.listObjectVersions(w, b)
+	case r.Method == http.MethodPost && hasParam(r, "delete"):
+		s.deleteObjects(w, r, b)
+	case r.Method == http.MethodDelete:
+		if len(b.objects) > 0 {
+			s3Error(w, r, http.StatusConflict, "BucketNotEmpty", "bucket is not empty")
+			return
+		}
+		delete(s.buckets, bucketName)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s %s is not implemented by the fake", r.Method, r.URL))
+	}
+}
+
+func hasParam(r *http.Request, name string) bool {
+	_, ok := r.URL.Query()[name]
+	return ok
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, b *bucket, key string) {
+	switch r.Method {
+	case http.MethodPut:
+		body := readBody(r)
+		b.objects[key] = object{
+			body:         body,
+			contentType:  r.Header.Get("Content-Type"),
+			cacheControl: r.Header.Get("Cache-Control"),
+		}
+		w.Header().Set("ETag", `"`+md5Hex(body)+`"`)
+	case http.MethodHead, http.MethodGet:
+		o, ok := b.objects[key]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey", "object does not exist")
+			return
+		}
+		w.Header().Set("ETag", `"`+md5Hex(o.body)+`"`)
+		w.Header().Set("Content-Type", o.contentType)
+		w.Header().Set("Cache-Control", o.cacheControl)
+		if r.Method == http.MethodGet {
+			w.Write(o.body)
+		}
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s %s is not implemented by the fake", r.Method, r.URL))
+	}
+}
+
+// The fake does not version objects, so every object is its only version.
+func (s *Server) listObjectVersions(w http.ResponseWriter, b *bucket) {
+	type version struct {
+		Key       string
+		VersionID string `xml:"VersionId"`
+		IsLatest  bool
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListVersionsResult"`
+		IsTruncated bool
+		Versions    []version `xml:"Version"`
+	}{}
+	keys := []string{}
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Versions = append(result.Versions, version{Key: key, VersionID: "null", IsLatest: true})
+	}
+	s3Result(w, result)
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, b *bucket) {
+	var input struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(readBody(r), &input); err != nil {
+		s3Error(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	for _, o := range input.Objects {
+		delete(b.objects, o.Key)
+	}
+	s3Result(w, struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+	}{})
+}
+
+// object returns the object at a path-style URL path, for the STS fake to
+// read an issuer's documents.
+func (s *Server) object(path string) ([]byte, bool) {
+	bucketName, key := splitPath(path)
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, false
+	}
+	o, ok := b.objects[key]
+	return o.body, ok
+}
@@ -0,0 +1,218 @@
+package fakeaws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const stsNamespace = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+var stsActions = map[string]queryAction{
+	"GetCallerIdentity":         (*Server).getCallerIdentity,
+	"AssumeRoleWithWebIdentity": (*Server).assumeRoleWithWebIdentity,
+}
+
+func (s *Server) getCallerIdentity(w http.ResponseWriter, form url.Values) {
+	queryResult(w, stsNamespace, "GetCallerIdentity", struct {
+		Arn     string
+		UserId  string
+		Account string
+	}{fmt.Sprintf("arn:aws:iam::%s:user/fake", AccountID), "AIDAFAKE", AccountID})
+}
+
+// assumeRoleWithWebIdentity checks the token like STS: its signature
+// against the JWKS the issuer's discovery document names, read from the
+// fake's own buckets, and its claims against the OIDC provider and the
+// trust policy of the role.
+func (s *Server) assumeRoleWithWebIdentity(w http.ResponseWriter, form url.Values) {
+	roleARN := form.Get("RoleArn")
+	var r *role
+	for _, candidate := range s.roles {
+		if candidate.arn == roleARN {
+			r = candidate
+		}
+	}
+	if r == nil {
+		queryError(w, http.StatusForbidden, "AccessDenied", "role "+roleARN+" cannot be found")
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(form.Get("WebIdentityToken"), claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		issuer, _ := claims["iss"].(string)
+		kid, _ := token.Header["kid"].(string)
+		return s.issuerKey(issuer, kid)
+	})
+	if err != nil {
+		queryError(w, http.StatusBadRequest, "InvalidIdentityToken", err.Error())
+		return
+	}
+
+	issuerURL := strings.TrimPrefix(claims["iss"].(string), "https://")
+	providerARN := fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", AccountID, issuerURL)
+	provider, ok := s.providers[providerARN]
+	if !ok {
+		queryError(w, http.StatusBadRequest, "InvalidIdentityToken", "no OIDC provider found for issuer "+issuerURL)
+		return
+	}
+	audience, _ := claims["aud"].(string)
+	if !containsString(provider.clientIDs, audience) {
+		queryError(w, http.StatusBadRequest, "InvalidIdentityToken", "incorrect token audience")
+		return
+	}
+	subject, _ := claims["sub"].(string)
+	if !trusts(r.trustPolicy, providerARN, map[string]string{issuerURL + ":aud": audience, issuerURL + ":sub": subject}) {
+		queryError(w, http.StatusForbidden, "AccessDenied", "not authorized to perform sts:AssumeRoleWithWebIdentity")
+		return
+	}
+
+	type credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	type assumedRoleUser struct {
+		Arn           string
+		AssumedRoleId string
+	}
+	sessionName := form.Get("RoleSessionName")
+	queryResult(w, stsNamespace, "AssumeRoleWithWebIdentity", struct {
+		Credentials                 credentials
+		SubjectFromWebIdentityToken string
+		AssumedRoleUser             assumedRoleUser
+		Audience                    string
+		Provider                    string
+	}{
+		Credentials: credentials{
+			AccessKeyId:     s.nextID("ASIA"),
+			SecretAccessKey: "fake-secret",
+			SessionToken:    "fake-session-token",
+			Expiration:      time.Now().Add(time.Hour).UTC().Format(timeFormat),
+		},
+		SubjectFromWebIdentityToken: subject,
+		AssumedRoleUser: assumedRoleUser{
+			Arn:           fmt.Sprintf("arn:aws:sts::%s:assumed-role/%s/%s", AccountID, r.name, sessionName),
+			AssumedRoleId: r.id + ":" + sessionName,
+		},
+		Audience: audience,
+		Provider: providerARN,
+	})
+}
+
+// issuerKey returns the public key with the key ID from the JWKS of the
+// issuer, which must be served from one of the fake's buckets.
+func (s *Server) issuerKey(issuer, kid string) (interface{}, error) {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	discoveryBytes, ok := s.object(path.Join(issuerURL.Path, ".well-known/openid-configuration"))
+	if !ok {
+		return nil, fmt.Errorf("issuer %s serves no discovery document", issuer)
+	}
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(discoveryBytes, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document names issuer %s, not %s", discovery.Issuer, issuer)
+	}
+
+	jwksURL, err := url.Parse(discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	jwksBytes, ok := s.object(jwksURL.Path)
+	if !ok {
+		return nil, fmt.Errorf("issuer %s serves no JWKS at %s", issuer, discovery.JWKSURI)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(jwksBytes, &keySet); err != nil {
+		return nil, err
+	}
+	keys := keySet.Key(kid)
+	if len(keys) == 0 {
+		return nil, errors.New("no key found for the key ID of the token")
+	}
+	return keys[0].Key, nil
+}
+
+// trusts reports whether a statement of the trust policy allows the
+// federated principal to assume the role with the token claims, handling
+// the StringEquals and StringLike conditions create writes.
+func trusts(trustPolicy, providerARN string, claims map[string]string) bool {
+	var policy struct {
+		Statement []struct {
+			Effect    string
+			Principal struct {
+				Federated string
+			}
+			Action    interface{}
+			Condition map[string]map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(trustPolicy), &policy); err != nil {
+		return false
+	}
+
+statements:
+	for _, statement := range policy.Statement {
+		if statement.Effect != "Allow" || statement.Principal.Federated != providerARN ||
+			!containsString(stringValues(statement.Action), "sts:AssumeRoleWithWebIdentity") {
+			continue
+		}
+		for operator, conditions := range statement.Condition {
+			for key, values := range conditions {
+				matched := false
+				for _, value := range stringValues(values) {
+					switch operator {
+					case "StringEquals":
+						matched = matched || claims[key] == value
+					case "StringLike":
+						ok, _ := path.Match(value, claims[key])
+						matched = matched || ok
+					}
+				}
+				if !matched {
+					continue statements
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// stringValues returns a policy value that is a string or a list of strings
+// as a list.
+func stringValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
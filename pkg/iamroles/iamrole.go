@@ -1,91 +1,378 @@
 package iamroles
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 
-	"k8s.io/apimachinery/pkg/util/yaml"
-
 	credreqv1 "github.com/openshift/cloud-credential-operator/pkg/apis/cloudcredential/v1"
 
 	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
 )
 
-func Create(createConfig create.Config, manifestsDir, oidcProviderARN, issuerURL string) {
-	if createConfig.CredentialsRequestsFile == "" {
-		return
+const (
+	// maxRoleNameLength is the IAM limit on role name length.
+	maxRoleNameLength = 64
+	// roleNameHashLength is the number of hex digits of the full name's hash
+	// kept when shortening a role name.
+	roleNameHashLength = 8
+
+	// CredentialsRequestTagKey tags each role with the namespace/name of the
+	// CredentialsRequest it was created for.
+	CredentialsRequestTagKey = "sts-preflight/credentials-request"
+)
+
+var validRoleName = regexp.MustCompile(`^[\w+=,.@-]+$`)
+
+// roleNameData are the fields available to the role name template.
+type roleNameData struct {
+	InfraName       string
+	Namespace       string
+	Name            string
+	SecretNamespace string
+	SecretName      string
+}
+
+// Role is the desired configuration of the role for a CredentialsRequest.
+type Role struct {
+	Name string
+	// LegacyName is the name earlier releases gave the role by cutting the
+	// default template's name at the IAM limit, when that differs from Name.
+	LegacyName string
+	// Owner is the namespace/name of the CredentialsRequest, or the token
+	// subject of the ServiceAccount for ServiceAccount roles.
+	Owner              string
+	Description        string
+	TrustPolicy        string
+	Statements         []StatementEntry
+	CredentialsRequest credreqs.CredentialsRequest
+}
+
+// Policies returns the inline policy document of the role, or the managed
+// policy documents when the policy is too large to be inline.
+func (r Role) Policies() (string, []string) {
+	policy := marshalPolicy(r.Statements)
+	if len(policy) <= maxInlinePolicySize {
+		return policy, nil
 	}
 
-	crFile, err := os.Open(createConfig.CredentialsRequestsFile)
+	return "", splitPolicy(r.Statements, maxManagedPolicySize)
+}
+
+// Create reconciles the roles of the CredentialsRequests and then writes
+// their Secrets in CredentialsRequest order.
+func Create(iamClient *iam.IAM, createConfig create.Config, state *create.State, crs []credreqs.CredentialsRequest, manifestsDir, oidcProviderARN, issuerURL string) {
+	roles := AdoptLegacyRoleNames(iamClient, DesiredRoles(createConfig, crs, oidcProviderARN, issuerURL))
+	profiles, err := ParseAdditionalProfiles(createConfig.AdditionalProfiles, crs)
 	if err != nil {
-		log.Fatalf("failed to open credentials request file: %s\n", err)
+		log.Panic(err.Error())
+	}
+
+	roleARNs := createRoles(iamClient, createConfig, state, roles)
+
+	ownerARNs := map[string]string{}
+	for i, role := range roles {
+		log.Printf("Role %s ready for CredentialsRequest %s", roleARNs[i], role.Owner)
+		ownerARNs[role.Owner] = roleARNs[i]
+	}
+	for i, role := range roles {
+		writeSecret(createConfig, role.CredentialsRequest, manifestsDir, roleARNs[i], profiles, ownerARNs)
+	}
+}
+
+// createRoles reconciles the roles with createConfig.Concurrency workers
+// sharing the IAM client and returns their ARNs. A failure stops the
+// remaining roles from being started and is raised again once the running
+// ones are done.
+func createRoles(iamClient *iam.IAM, createConfig create.Config, state *create.State, roles []Role) []string {
+	roleARNs := make([]string, len(roles))
+
+	workers := createConfig.Concurrency
+	if workers < 1 {
+		workers = 1
 	}
 
-	decoder := yaml.NewYAMLOrJSONDecoder(crFile, 4096)
-	for {
-		cr := &credreqv1.CredentialsRequest{}
-		if err := decoder.Decode(cr); err != nil {
-			if err == io.EOF {
-				break
+	var (
+		wg          sync.WaitGroup
+		failureOnce sync.Once
+		failure     interface{}
+	)
+	jobs := make(chan int)
+	failed := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							failureOnce.Do(func() {
+								failure = r
+								close(failed)
+							})
+						}
+					}()
+					roleARNs[i] = createRole(iamClient, createConfig, state, roles[i])
+				}()
 			}
-			log.Fatalf("Failed to decode CredentialsRequest: %s", err)
+		}()
+	}
+
+feed:
+	for i := range roles {
+		select {
+		case jobs <- i:
+		case <-failed:
+			break feed
 		}
+	}
+	close(jobs)
+	wg.Wait()
+	if failure != nil {
+		panic(failure)
+	}
+	return roleARNs
+}
 
-		processCredentialsRequest(cr, manifestsDir, createConfig.InfraName, oidcProviderARN, issuerURL)
+// DesiredRoles returns the roles for the CredentialsRequests.
+func DesiredRoles(createConfig create.Config, crs []credreqs.CredentialsRequest, oidcProviderARN, issuerURL string) []Role {
+	roleNameTemplate, err := template.New("role-name").Option("missingkey=error").Parse(createConfig.RoleNameTemplate)
+	if err != nil {
+		log.Panicf("failed to parse role name template: %s\n", err)
+	}
+	// role name -> namespace/name of the CredentialsRequest using it
+	roleOwners := map[string]string{}
+
+	// The role of a CredentialsRequest is also assumed through the
+	// additional profiles in the Secrets of others.
+	subjects := map[string][]string{}
+	for _, cr := range crs {
+		subjects[cr.NamespacedName()] = serviceAccountSubjects(cr, createConfig.ServiceAccountTrust)
+	}
+	profiles, err := ParseAdditionalProfiles(createConfig.AdditionalProfiles, crs)
+	if err != nil {
+		log.Panic(err.Error())
 	}
+	for _, profile := range profiles {
+		for _, subject := range subjects[profile.CredentialsRequest] {
+			if !containsString(subjects[profile.RoleOf], subject) {
+				subjects[profile.RoleOf] = append(subjects[profile.RoleOf], subject)
+			}
+		}
+	}
+
+	roles := []Role{}
+	for _, cr := range crs {
+		owner := cr.NamespacedName()
+		roleName := renderRoleName(roleNameTemplate, roleNameData{
+			InfraName:       createConfig.InfraName,
+			Namespace:       cr.Namespace,
+			Name:            cr.Name,
+			SecretNamespace: cr.Spec.SecretRef.Namespace,
+			SecretName:      cr.Spec.SecretRef.Name,
+		})
+		if existingOwner, ok := roleOwners[roleName]; ok && existingOwner != owner {
+			log.Panicf("CredentialsRequests %s and %s both map to role name %s, adjust --role-name-template", existingOwner, owner, roleName)
+		}
+		roleOwners[roleName] = owner
+
+		legacyName := ""
+		if createConfig.RoleNameTemplate == create.DefaultRoleNameTemplate {
+			fullName := fmt.Sprintf("%s-%s-%s", createConfig.InfraName, cr.Spec.SecretRef.Namespace, cr.Spec.SecretRef.Name)
+			if len(fullName) > maxRoleNameLength {
+				legacyName = fullName[:maxRoleNameLength]
+			}
+		}
+
+		roles = append(roles, Role{
+			Name:               roleName,
+			LegacyName:         legacyName,
+			Owner:              owner,
+			Description:        fmt.Sprintf("OpenShift role for %s/%s", cr.Spec.SecretRef.Namespace, cr.Spec.SecretRef.Name),
+			TrustPolicy:        createTrustPolicy(oidcProviderARN, issuerURL, subjects[owner]),
+			Statements:         rolePolicyStatements(cr.AWSProviderSpec.StatementEntries),
+			CredentialsRequest: cr,
+		})
+	}
+
+	return roles
+}
+
+// AdoptLegacyRoleNames renames the roles that do not exist yet to their
+// legacy name when a role of that name was created for the same
+// CredentialsRequest, as told by its owner tag or, for untagged roles, by its
+// description. Installs made before names were shortened with a hash keep
+// their roles and the role ARNs in their Secrets.
+func AdoptLegacyRoleNames(iamClient *iam.IAM, roles []Role) []Role {
+	adopted := make([]Role, len(roles))
+	for i, role := range roles {
+		adopted[i] = role
+		if role.LegacyName == "" || getRole(iamClient, role.Name) != nil {
+			continue
+		}
+		legacy := getRole(iamClient, role.LegacyName)
+		if legacy == nil {
+			continue
+		}
+
+		owner, tagged := "", false
+		for _, tag := range legacy.Tags {
+			if aws.StringValue(tag.Key) == CredentialsRequestTagKey {
+				owner, tagged = aws.StringValue(tag.Value), true
+			}
+		}
+		if (tagged && owner == role.Owner) || (!tagged && aws.StringValue(legacy.Description) == role.Description) {
+			log.Printf("Keeping the legacy role name %s for CredentialsRequest %s instead of %s", role.LegacyName, role.Owner, role.Name)
+			adopted[i].Name = role.LegacyName
+		}
+	}
+	return adopted
 }
 
-func processCredentialsRequest(cr *credreqv1.CredentialsRequest, manifestsDir, infraName, oidcProviderARN, issuerURL string) {
-	codec, err := credreqv1.NewCodec()
+// getRole returns the role, or nil if it does not exist.
+func getRole(iamClient *iam.IAM, roleName string) *iam.Role {
+	output, err := iamClient.GetRole(&iam.GetRoleInput{
+		RoleName: aws.String(roleName),
+	})
 	if err != nil {
-		fmt.Printf("Failed to create credReq codec: %s\n", err)
-		return
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return nil
+		}
+		log.Panic(err.Error())
+	}
+	return output.Role
+}
+
+// ValidRoleName reports whether IAM accepts the role name as is.
+func ValidRoleName(roleName string) bool {
+	return len(roleName) <= maxRoleNameLength && validRoleName.MatchString(roleName)
+}
+
+// renderRoleName executes the role name template and shortens the result to
+// fit the IAM limit. Shortened names end in a hash of the full name so that
+// names sharing a long prefix stay distinct.
+func renderRoleName(roleNameTemplate *template.Template, data roleNameData) string {
+	var b strings.Builder
+	if err := roleNameTemplate.Execute(&b, data); err != nil {
+		log.Panicf("Failed to render role name: %s", err)
 	}
+	roleName := b.String()
 
-	awsProviderSpec := credreqv1.AWSProviderSpec{}
-	if err := codec.DecodeProviderSpec(cr.Spec.ProviderSpec, &awsProviderSpec); err != nil {
-		log.Fatalf("failed to decode the provider spec: %s\n", err)
-		return
+	if !validRoleName.MatchString(roleName) {
+		log.Panicf("Role name %q contains characters not allowed by IAM", roleName)
 	}
 
-	if awsProviderSpec.Kind != "AWSProviderSpec" {
-		fmt.Printf("CredentialsRequest %s/%s is not of type AWS\n", cr.Namespace, cr.Name)
-		return
+	if len(roleName) <= maxRoleNameLength {
+		return roleName
 	}
 
-	// infraName-targetNamespace-targetSecretName
-	roleName := fmt.Sprintf("%s-%s-%s", infraName, cr.Spec.SecretRef.Namespace, cr.Spec.SecretRef.Name)
-	roleARN := createRole(roleName, awsProviderSpec.StatementEntries, fmt.Sprintf("%s/%s", cr.Spec.SecretRef.Namespace, cr.Spec.SecretRef.Name), oidcProviderARN, issuerURL)
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(roleName)))[:roleNameHashLength]
+	return fmt.Sprintf("%s-%s", roleName[:maxRoleNameLength-roleNameHashLength-1], hash)
+}
+
+// serviceAccountSubjects returns the token subjects allowed to assume the role
+// for the CredentialsRequest. Wildcard subjects contain a '*'. Explicit trust
+// never falls back to a wildcard: lint rejects CredentialsRequests without
+// serviceAccountNames unless wildcard trust is chosen.
+func serviceAccountSubjects(cr credreqs.CredentialsRequest, trust string) []string {
+	namespace := cr.Spec.SecretRef.Namespace
+	if trust == create.ServiceAccountTrustExplicit && len(cr.ServiceAccountNames) == 0 {
+		log.Panicf("CredentialsRequest %s/%s lists no serviceAccountNames, pass --service-account-trust %s to trust all ServiceAccounts in namespace %s", cr.Namespace, cr.Name, create.ServiceAccountTrustWildcard, namespace)
+	}
 
-	writeSecret(cr, manifestsDir, roleARN)
+	if trust == create.ServiceAccountTrustWildcard {
+		return []string{fmt.Sprintf("system:serviceaccount:%s:*", namespace)}
+	}
+
+	subjects := []string{}
+	for _, name := range cr.ServiceAccountNames {
+		subjects = append(subjects, fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name))
+	}
+	sort.Strings(subjects)
+	return subjects
 }
 
-func createRole(roleName string, statementEntries []credreqv1.StatementEntry, namespacedName, oidcProviderARN, issuerURL string) string {
+// createTrustPolicy returns a trust policy allowing the given token subjects,
+// issued for the "openshift" audience, to assume the role.
+func createTrustPolicy(oidcProviderARN, issuerURL string, subjects []string) string {
+	subOperator := "StringEquals"
+	for _, subject := range subjects {
+		if strings.Contains(subject, "*") {
+			subOperator = "StringLike"
+		}
+	}
+
+	condition := map[string]map[string]interface{}{
+		"StringEquals": {
+			fmt.Sprintf("%s:aud", issuerURL): "openshift",
+		},
+	}
+	if _, ok := condition[subOperator]; !ok {
+		condition[subOperator] = map[string]interface{}{}
+	}
+	condition[subOperator][fmt.Sprintf("%s:sub", issuerURL)] = subjects
+
+	trustPolicy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect": "Allow",
+				"Principal": map[string]string{
+					"Federated": oidcProviderARN,
+				},
+				"Action":    "sts:AssumeRoleWithWebIdentity",
+				"Condition": condition,
+			},
+		},
+	}
 
-	var shortenedRoleName string
-	if len(roleName) > 64 {
-		shortenedRoleName = roleName[0:64]
-	} else {
-		shortenedRoleName = roleName
+	b, err := json.Marshal(trustPolicy)
+	if err != nil {
+		log.Panicf("Failed to marshal the trust policy to JSON: %s", err)
+	}
+
+	return string(b)
+}
+
+// PolicyDocumentsEqual compares a policy document returned by AWS with a
+// desired one semantically. The current document may be URL encoded, as
+// returned by the IAM API; the desired one is used as rendered.
+func PolicyDocumentsEqual(current, desired string) bool {
+	var currentDoc, desiredDoc interface{}
+	if decoded, err := url.PathUnescape(current); err == nil {
+		current = decoded
+	}
+	if err := json.Unmarshal([]byte(current), &currentDoc); err != nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(desired), &desiredDoc); err != nil {
+		return false
 	}
+	return reflect.DeepEqual(currentDoc, desiredDoc)
+}
 
-	sess := session.Must(session.NewSession())
-	iamClient := iam.New(sess)
+func createRole(iamClient *iam.IAM, createConfig create.Config, state *create.State, desired Role) string {
+	roleName := desired.Name
 
 	var role *iam.Role
 	outRole, err := iamClient.GetRole(&iam.GetRoleInput{
-		RoleName: aws.String(shortenedRoleName),
+		RoleName: aws.String(roleName),
 	})
 
 	if err != nil {
@@ -93,121 +380,212 @@ func createRole(roleName string, statementEntries []credreqv1.StatementEntry, na
 		if errors.As(err, &aerr) {
 			switch aerr.Code() {
 			case iam.ErrCodeNoSuchEntityException:
-
-				// TODO: add conditions so that only the right ServiceAccount(s) can assume the role.
-				rolePolicyTemplate := `{
-					"Version": "2012-10-17",
-					"Statement": [
-						{
-							"Effect": "Allow",
-							"Principal": {
-								"Federated": "%s"
-							},
-							"Action": "sts:AssumeRoleWithWebIdentity",
-							"Condition": {
-								"StringEquals": {
-									"%s:aud": "openshift"
-								}
-							}
-						}
-					]
-				}`
-
-				roleOutput, err := iamClient.CreateRole(&iam.CreateRoleInput{
-					RoleName:                 aws.String(shortenedRoleName),
-					Description:              aws.String(fmt.Sprintf("OpenShift role for %s", namespacedName)),
-					AssumeRolePolicyDocument: aws.String(fmt.Sprintf(rolePolicyTemplate, oidcProviderARN, issuerURL)),
+				input := &iam.CreateRoleInput{
+					RoleName:                 aws.String(roleName),
+					Description:              aws.String(desired.Description),
+					AssumeRolePolicyDocument: aws.String(desired.TrustPolicy),
+				}
+				SetRoleMetadata(input, createConfig)
+				input.Tags = append(input.Tags, &iam.Tag{
+					Key:   aws.String(CredentialsRequestTagKey),
+					Value: aws.String(desired.Owner),
 				})
+
+				roleOutput, err := iamClient.CreateRole(input)
 				if err != nil {
-					log.Fatalf("Failed to create role: %s", err)
+					log.Panicf("Failed to create role: %s", err)
 				}
 
 				role = roleOutput.Role
 				log.Printf("Role %s created", *role.Arn)
+				state.Record(create.KindRole, roleName, create.StepCreated)
 
 			default:
-				log.Fatal(err.Error())
+				log.Panic(err.Error())
 			}
 
 		}
 	} else {
 		role = outRole.Role
 		log.Printf("Existing role %s found", *role.Arn)
+
+		if checkRoleOwner(iamClient, role, desired.Owner) {
+			state.Record(create.KindRole, roleName, create.StepUpdated)
+		}
+		if UpdateRoleMetadata(iamClient, role, createConfig) {
+			state.Record(create.KindRole, roleName, create.StepUpdated)
+		}
+
+		if !PolicyDocumentsEqual(aws.StringValue(role.AssumeRolePolicyDocument), desired.TrustPolicy) {
+			_, err := iamClient.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+				RoleName:       role.RoleName,
+				PolicyDocument: aws.String(desired.TrustPolicy),
+			})
+			if err != nil {
+				log.Panicf("Failed to update trust policy: %s", err)
+			}
+			log.Printf("Trust policy of role %s updated", *role.Arn)
+			state.Record(create.KindRole, roleName, create.StepUpdated)
+		}
 	}
 
-	policy := createRolePolicy(statementEntries)
-	_, err = iamClient.PutRolePolicy(&iam.PutRolePolicyInput{
-		PolicyName:     aws.String(shortenedRoleName),
-		RoleName:       role.RoleName,
-		PolicyDocument: aws.String(policy),
+	putRolePolicies(iamClient, createConfig, state, role, desired)
+
+	return *role.Arn
+}
+
+// checkRoleOwner fails if an existing role was created for a different
+// CredentialsRequest. Untagged roles are adopted by tagging them, in which
+// case it returns true.
+func checkRoleOwner(iamClient *iam.IAM, role *iam.Role, owner string) bool {
+	for _, tag := range role.Tags {
+		if aws.StringValue(tag.Key) != CredentialsRequestTagKey {
+			continue
+		}
+		if aws.StringValue(tag.Value) != owner {
+			log.Panicf("Role %s belongs to CredentialsRequest %s, not %s; refusing to share it", *role.RoleName, aws.StringValue(tag.Value), owner)
+		}
+		return false
+	}
+
+	log.Printf("Role %s has no %s tag, adopting it for CredentialsRequest %s", *role.RoleName, CredentialsRequestTagKey, owner)
+	_, err := iamClient.TagRole(&iam.TagRoleInput{
+		RoleName: role.RoleName,
+		Tags: []*iam.Tag{
+			{
+				Key:   aws.String(CredentialsRequestTagKey),
+				Value: aws.String(owner),
+			},
+		},
 	})
 	if err != nil {
-		log.Fatalf("Failed to put role policy: %s", err)
+		log.Panicf("Failed to tag role: %s", err)
 	}
-
-	return *role.Arn
+	return true
 }
 
-// StatementEntry is a simple type used to serialize to AWS' PolicyDocument format.
-type StatementEntry struct {
-	Effect   string
-	Action   []string
-	Resource string
-	// Must "omitempty" otherwise we send unacceptable JSON to the AWS API when no
-	// condition is defined.
-	Condition credreqv1.IAMPolicyCondition `json:",omitempty"`
+// IAMTags converts a tag map into IAM tags, sorted by key.
+func IAMTags(tags map[string]string) []*iam.Tag {
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	iamTags := []*iam.Tag{}
+	for _, k := range keys {
+		iamTags = append(iamTags, &iam.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(tags[k]),
+		})
+	}
+	return iamTags
 }
 
-// PolicyDocument is a simple type used to serialize to AWS' PolicyDocument format.
-type PolicyDocument struct {
-	Version   string
-	Statement []StatementEntry
+// SetRoleMetadata sets the configured path, permissions boundary, maximum
+// session duration and tags on a role about to be created.
+func SetRoleMetadata(input *iam.CreateRoleInput, createConfig create.Config) {
+	input.Path = aws.String(createConfig.RolePath)
+	input.MaxSessionDuration = aws.Int64(createConfig.MaxSessionDuration)
+	input.Tags = IAMTags(createConfig.ResourceTags())
+	if createConfig.PermissionsBoundaryARN != "" {
+		input.PermissionsBoundary = aws.String(createConfig.PermissionsBoundaryARN)
+	}
 }
 
-func createRolePolicy(statements []credreqv1.StatementEntry) string {
-	policyDocument := PolicyDocument{
-		Version:   "2012-10-17",
-		Statement: []StatementEntry{},
+// UpdateRoleMetadata brings the permissions boundary, maximum session
+// duration and tags of an existing role in line with the config. The path of
+// a role cannot be changed, so a mismatch is only reported. It returns
+// whether anything was changed.
+func UpdateRoleMetadata(iamClient *iam.IAM, role *iam.Role, createConfig create.Config) bool {
+	updated := false
+
+	if aws.StringValue(role.Path) != createConfig.RolePath {
+		log.Printf("Role %s has path %s, not %s; recreate the role to change it", *role.RoleName, aws.StringValue(role.Path), createConfig.RolePath)
+	}
+
+	if aws.Int64Value(role.MaxSessionDuration) != createConfig.MaxSessionDuration {
+		_, err := iamClient.UpdateRole(&iam.UpdateRoleInput{
+			RoleName:           role.RoleName,
+			MaxSessionDuration: aws.Int64(createConfig.MaxSessionDuration),
+		})
+		if err != nil {
+			log.Panicf("Failed to update role: %s", err)
+		}
+		log.Printf("Maximum session duration of role %s set to %d", *role.RoleName, createConfig.MaxSessionDuration)
+		updated = true
 	}
 
-	for _, entry := range statements {
-		policyDocument.Statement = append(policyDocument.Statement,
-			StatementEntry{
-				Effect:    entry.Effect,
-				Action:    entry.Action,
-				Resource:  entry.Resource,
-				Condition: entry.PolicyCondition,
+	var currentBoundary string
+	if role.PermissionsBoundary != nil {
+		currentBoundary = aws.StringValue(role.PermissionsBoundary.PermissionsBoundaryArn)
+	}
+	if currentBoundary != createConfig.PermissionsBoundaryARN {
+		if createConfig.PermissionsBoundaryARN == "" {
+			_, err := iamClient.DeleteRolePermissionsBoundary(&iam.DeleteRolePermissionsBoundaryInput{
+				RoleName: role.RoleName,
 			})
+			if err != nil {
+				log.Panicf("Failed to delete role permissions boundary: %s", err)
+			}
+			log.Printf("Permissions boundary of role %s removed", *role.RoleName)
+			updated = true
+		} else {
+			_, err := iamClient.PutRolePermissionsBoundary(&iam.PutRolePermissionsBoundaryInput{
+				RoleName:            role.RoleName,
+				PermissionsBoundary: aws.String(createConfig.PermissionsBoundaryARN),
+			})
+			if err != nil {
+				log.Panicf("Failed to put role permissions boundary: %s", err)
+			}
+			log.Printf("Permissions boundary of role %s set to %s", *role.RoleName, createConfig.PermissionsBoundaryARN)
+			updated = true
+		}
 	}
 
-	b, err := json.Marshal(&policyDocument)
-	if err != nil {
-		log.Fatalf("Failed to marshal the policy to JSON: %s", err)
+	if tags := ChangedTags(role.Tags, createConfig.ResourceTags()); len(tags) > 0 {
+		_, err := iamClient.TagRole(&iam.TagRoleInput{
+			RoleName: role.RoleName,
+			Tags:     tags,
+		})
+		if err != nil {
+			log.Panicf("Failed to tag role: %s", err)
+		}
+		log.Printf("Tags of role %s updated", *role.RoleName)
+		updated = true
 	}
 
-	return string(b)
+	return updated
 }
 
-func writeSecret(cr *credreqv1.CredentialsRequest, manifestsDir, roleARN string) {
-	fileName := fmt.Sprintf("%s-%s-credentials.yaml", cr.Spec.SecretRef.Namespace, cr.Spec.SecretRef.Name)
-	filePath := filepath.Join(manifestsDir, fileName)
-
-	fileData := fmt.Sprintf(`apiVersion: v1
-stringData:
-  credentials: |-
-    [default]
-    role_arn = %s
-    web_identity_token_file = /var/run/secrets/openshift/serviceaccount/token
-kind: Secret
-metadata:
-  name: %s
-  namespace: %s
-type: Opaque
-`, roleARN, cr.Spec.SecretRef.Name, cr.Spec.SecretRef.Namespace)
+// ChangedTags returns the tags whose value in current differs from wanted.
+func ChangedTags(current []*iam.Tag, wanted map[string]string) []*iam.Tag {
+	currentTags := map[string]string{}
+	for _, tag := range current {
+		currentTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
 
-	if err := ioutil.WriteFile(filePath, []byte(fileData), 0600); err != nil {
-		log.Fatalf("Failed to save Secret file: %s", err)
+	changed := map[string]string{}
+	for k, v := range wanted {
+		if value, ok := currentTags[k]; !ok || value != v {
+			changed[k] = v
+		}
 	}
+	return IAMTags(changed)
+}
+
+// StatementEntry is a simple type used to serialize to AWS' PolicyDocument format.
+type StatementEntry struct {
+	Effect   string
+	Action   []string
+	Resource string
+	// Must "omitempty" otherwise we send unacceptable JSON to the AWS API when no
+	// condition is defined.
+	Condition credreqv1.IAMPolicyCondition `json:",omitempty"`
+}
 
-	log.Printf("Saved credentials configuration to: %s", filePath)
+// PolicyDocument is a simple type used to serialize to AWS' PolicyDocument format.
+type PolicyDocument struct {
+	Version   string
+	Statement []StatementEntry
 }
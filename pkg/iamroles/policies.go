@@ -0,0 +1,381 @@
+package iamroles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+
+	credreqv1 "github.com/openshift/cloud-credential-operator/pkg/apis/cloudcredential/v1"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+const (
+	// maxInlinePolicySize is the IAM limit on the size of a role's inline
+	// policies, not counting whitespace.
+	maxInlinePolicySize = 10240
+	// maxManagedPolicySize is the IAM limit on the size of a managed policy,
+	// not counting whitespace.
+	maxManagedPolicySize = 6144
+	// maxAttachedPolicies is the default IAM quota of managed policies
+	// attached to a role.
+	maxAttachedPolicies = 10
+	// maxPolicyVersions is the IAM limit on stored versions of a managed
+	// policy.
+	maxPolicyVersions = 5
+)
+
+// rolePolicyStatements converts the CredentialsRequest statements, merging
+// the actions of statements that only differ in their actions.
+func rolePolicyStatements(statements []credreqv1.StatementEntry) []StatementEntry {
+	merged := []StatementEntry{}
+	index := map[string]int{}
+	for _, entry := range statements {
+		condition, err := json.Marshal(entry.PolicyCondition)
+		if err != nil {
+			log.Panicf("Failed to marshal the policy condition to JSON: %s", err)
+		}
+		key := fmt.Sprintf("%s|%s|%s", entry.Effect, entry.Resource, condition)
+
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, StatementEntry{
+				Effect:    entry.Effect,
+				Action:    []string{},
+				Resource:  entry.Resource,
+				Condition: entry.PolicyCondition,
+			})
+			i = len(merged) - 1
+		}
+
+		for _, action := range entry.Action {
+			if !containsString(merged[i].Action, action) {
+				merged[i].Action = append(merged[i].Action, action)
+			}
+		}
+	}
+
+	return merged
+}
+
+// marshalPolicy returns the minified policy document for the statements.
+func marshalPolicy(statements []StatementEntry) string {
+	b, err := json.Marshal(&PolicyDocument{
+		Version:   "2012-10-17",
+		Statement: statements,
+	})
+	if err != nil {
+		log.Panicf("Failed to marshal the policy to JSON: %s", err)
+	}
+
+	return string(b)
+}
+
+// splitPolicy packs the statements into as few policy documents as possible
+// that each fit maxSize. Statements too large on their own are split by
+// action.
+func splitPolicy(statements []StatementEntry, maxSize int) []string {
+	fitting := []StatementEntry{}
+	for _, statement := range statements {
+		fitting = append(fitting, splitStatement(statement, maxSize)...)
+	}
+
+	policies := []string{}
+	current := []StatementEntry{}
+	for _, statement := range fitting {
+		if len(current) > 0 && len(marshalPolicy(append(current, statement))) > maxSize {
+			policies = append(policies, marshalPolicy(current))
+			current = []StatementEntry{}
+		}
+		current = append(current, statement)
+	}
+	if len(current) > 0 {
+		policies = append(policies, marshalPolicy(current))
+	}
+
+	return policies
+}
+
+func splitStatement(statement StatementEntry, maxSize int) []StatementEntry {
+	if len(marshalPolicy([]StatementEntry{statement})) <= maxSize {
+		return []StatementEntry{statement}
+	}
+	if len(statement.Action) < 2 {
+		log.Panicf("Policy statement for %v on %s does not fit in a managed policy", statement.Action, statement.Resource)
+	}
+
+	half := len(statement.Action) / 2
+	first, second := statement, statement
+	first.Action = statement.Action[:half]
+	second.Action = statement.Action[half:]
+	return append(splitStatement(first, maxSize), splitStatement(second, maxSize)...)
+}
+
+// putRolePolicies grants the role the statements. They are put in a single
+// inline policy when it fits the IAM size limit, or else spread over
+// customer managed policies attached to the role. Managed policies are
+// recorded in the state and removed again once they are no longer needed.
+func putRolePolicies(iamClient *iam.IAM, createConfig create.Config, state *create.State, role *iam.Role, desired Role) {
+	roleName := aws.StringValue(role.RoleName)
+	policy, managedPolicies := desired.Policies()
+
+	current, err := iamClient.GetRolePolicy(&iam.GetRolePolicyInput{
+		PolicyName: aws.String(roleName),
+		RoleName:   role.RoleName,
+	})
+	var aerr awserr.Error
+	if err != nil && !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+		log.Panicf("Failed to get role policy: %s", err)
+	}
+	inlineExists := err == nil
+
+	if len(managedPolicies) == 0 {
+		if !inlineExists || !PolicyDocumentsEqual(aws.StringValue(current.PolicyDocument), policy) {
+			_, err := iamClient.PutRolePolicy(&iam.PutRolePolicyInput{
+				PolicyName:     aws.String(roleName),
+				RoleName:       role.RoleName,
+				PolicyDocument: aws.String(policy),
+			})
+			if err != nil {
+				log.Panicf("Failed to put role policy: %s", err)
+			}
+			log.Printf("Inline policy of role %s updated", roleName)
+			state.Record(create.KindRole, roleName, create.StepUpdated)
+		}
+	} else {
+		if len(managedPolicies) > maxAttachedPolicies {
+			log.Panicf("Policy for role %s needs %d managed policies, more than the %d that can be attached", roleName, len(managedPolicies), maxAttachedPolicies)
+		}
+		log.Printf("Policy for role %s is over the %d character inline limit; using %d managed policies", roleName, maxInlinePolicySize, len(managedPolicies))
+
+		if inlineExists {
+			_, err := iamClient.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+				PolicyName: aws.String(roleName),
+				RoleName:   role.RoleName,
+			})
+			if err != nil {
+				log.Panicf("Failed to delete role policy: %s", err)
+			}
+			log.Printf("Inline policy of role %s deleted", roleName)
+			state.Record(create.KindRole, roleName, create.StepUpdated)
+		}
+	}
+
+	attached := map[string]string{}
+	err = iamClient.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{
+		RoleName: role.RoleName,
+	}, func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.AttachedPolicies {
+			attached[aws.StringValue(policy.PolicyArn)] = aws.StringValue(policy.PolicyName)
+		}
+		return true
+	})
+	if err != nil {
+		log.Panicf("Failed to list attached role policies: %s", err)
+	}
+
+	wanted := map[string]bool{}
+	for i, document := range managedPolicies {
+		policyARN := putManagedPolicy(iamClient, createConfig, state, role, ManagedPolicyName(roleName, i), document)
+		wanted[policyARN] = true
+		state.AddPolicyARN(policyARN)
+
+		if _, ok := attached[policyARN]; ok {
+			continue
+		}
+		_, err := iamClient.AttachRolePolicy(&iam.AttachRolePolicyInput{
+			PolicyArn: aws.String(policyARN),
+			RoleName:  role.RoleName,
+		})
+		if err != nil {
+			log.Panicf("Failed to attach policy: %s", err)
+		}
+		log.Printf("Managed policy %s attached to role %s", policyARN, roleName)
+		state.Record(create.KindRole, roleName, create.StepUpdated)
+	}
+
+	// Remove managed policies from a previous run that are no longer needed.
+	attachedARNs := []string{}
+	for policyARN := range attached {
+		attachedARNs = append(attachedARNs, policyARN)
+	}
+	sort.Strings(attachedARNs)
+	for _, policyARN := range attachedARNs {
+		if wanted[policyARN] || !strings.HasPrefix(attached[policyARN], roleName+"-") {
+			continue
+		}
+		DeleteManagedPolicy(iamClient, policyARN)
+		state.RemovePolicyARN(policyARN)
+		state.Record(create.KindPolicy, policyARN, create.StepDeleted)
+	}
+}
+
+// ManagedPolicyName returns the name of the i-th managed policy holding part
+// of the role's policy.
+func ManagedPolicyName(roleName string, i int) string {
+	return fmt.Sprintf("%s-%d", roleName, i+1)
+}
+
+// putManagedPolicy creates the customer managed policy, or makes the document
+// the default version of an existing one, and returns its ARN.
+func putManagedPolicy(iamClient *iam.IAM, createConfig create.Config, state *create.State, role *iam.Role, policyName, document string) string {
+	roleARN, err := arn.Parse(aws.StringValue(role.Arn))
+	if err != nil {
+		log.Panicf("Failed to parse role ARN: %s", err)
+	}
+	policyARN := arn.ARN{
+		Partition: roleARN.Partition,
+		Service:   "iam",
+		AccountID: roleARN.AccountID,
+		Resource:  fmt.Sprintf("policy%s%s", createConfig.RolePath, policyName),
+	}.String()
+
+	_, err = iamClient.CreatePolicy(&iam.CreatePolicyInput{
+		PolicyName:     aws.String(policyName),
+		Path:           aws.String(createConfig.RolePath),
+		PolicyDocument: aws.String(document),
+		Description:    aws.String(fmt.Sprintf("Part of the policy for role %s", aws.StringValue(role.RoleName))),
+		Tags:           IAMTags(createConfig.ResourceTags()),
+	})
+	if err == nil {
+		log.Printf("Managed policy %s created", policyARN)
+		state.Record(create.KindPolicy, policyARN, create.StepCreated)
+		return policyARN
+	}
+	var aerr awserr.Error
+	if !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeEntityAlreadyExistsException) {
+		log.Panicf("Failed to create managed policy: %s", err)
+	}
+
+	versions, err := iamClient.ListPolicyVersions(&iam.ListPolicyVersionsInput{
+		PolicyArn: aws.String(policyARN),
+	})
+	if err != nil {
+		log.Panicf("Failed to list managed policy versions: %s", err)
+	}
+	for _, version := range versions.Versions {
+		if !aws.BoolValue(version.IsDefaultVersion) {
+			continue
+		}
+		current, err := iamClient.GetPolicyVersion(&iam.GetPolicyVersionInput{
+			PolicyArn: aws.String(policyARN),
+			VersionId: version.VersionId,
+		})
+		if err != nil {
+			log.Panicf("Failed to get managed policy version: %s", err)
+		}
+		if PolicyDocumentsEqual(aws.StringValue(current.PolicyVersion.Document), document) {
+			return policyARN
+		}
+	}
+	if len(versions.Versions) >= maxPolicyVersions {
+		// Make room by deleting the oldest version that is not the default.
+		for i := len(versions.Versions) - 1; i >= 0; i-- {
+			version := versions.Versions[i]
+			if aws.BoolValue(version.IsDefaultVersion) {
+				continue
+			}
+			_, err := iamClient.DeletePolicyVersion(&iam.DeletePolicyVersionInput{
+				PolicyArn: aws.String(policyARN),
+				VersionId: version.VersionId,
+			})
+			if err != nil {
+				log.Panicf("Failed to delete managed policy version: %s", err)
+			}
+			break
+		}
+	}
+
+	_, err = iamClient.CreatePolicyVersion(&iam.CreatePolicyVersionInput{
+		PolicyArn:      aws.String(policyARN),
+		PolicyDocument: aws.String(document),
+		SetAsDefault:   aws.Bool(true),
+	})
+	if err != nil {
+		log.Panicf("Failed to update managed policy: %s", err)
+	}
+	log.Printf("Managed policy %s updated", policyARN)
+	state.Record(create.KindPolicy, policyARN, create.StepUpdated)
+
+	return policyARN
+}
+
+// DeleteManagedPolicy detaches the customer managed policy from every role
+// and deletes it with all its versions.
+func DeleteManagedPolicy(iamClient *iam.IAM, policyARN string) {
+	roleNames := []*string{}
+	err := iamClient.ListEntitiesForPolicyPages(&iam.ListEntitiesForPolicyInput{
+		PolicyArn: aws.String(policyARN),
+	}, func(page *iam.ListEntitiesForPolicyOutput, lastPage bool) bool {
+		for _, role := range page.PolicyRoles {
+			roleNames = append(roleNames, role.RoleName)
+		}
+		return true
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return
+		}
+		log.Panicf("Failed to list entities for policy: %s", err)
+	}
+	for _, roleName := range roleNames {
+		_, err := iamClient.DetachRolePolicy(&iam.DetachRolePolicyInput{
+			PolicyArn: aws.String(policyARN),
+			RoleName:  roleName,
+		})
+		if err != nil {
+			log.Panicf("Failed to detach policy: %s", err)
+		}
+	}
+
+	versionIDs := []*string{}
+	err = iamClient.ListPolicyVersionsPages(&iam.ListPolicyVersionsInput{
+		PolicyArn: aws.String(policyARN),
+	}, func(page *iam.ListPolicyVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			if !aws.BoolValue(version.IsDefaultVersion) {
+				versionIDs = append(versionIDs, version.VersionId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Panicf("Failed to list managed policy versions: %s", err)
+	}
+	for _, versionID := range versionIDs {
+		_, err := iamClient.DeletePolicyVersion(&iam.DeletePolicyVersionInput{
+			PolicyArn: aws.String(policyARN),
+			VersionId: versionID,
+		})
+		if err != nil {
+			log.Panicf("Failed to delete managed policy version: %s", err)
+		}
+	}
+
+	_, err = iamClient.DeletePolicy(&iam.DeletePolicyInput{
+		PolicyArn: aws.String(policyARN),
+	})
+	if err != nil {
+		log.Panicf("Failed to delete managed policy: %s", err)
+	}
+	log.Printf("Managed policy %s deleted", policyARN)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
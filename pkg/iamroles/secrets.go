@@ -0,0 +1,129 @@
+package iamroles
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	credreqv1 "github.com/openshift/cloud-credential-operator/pkg/apis/cloudcredential/v1"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+)
+
+const (
+	// defaultTokenPath is where OpenShift mounts the projected ServiceAccount
+	// token for CredentialsRequests without a cloudTokenPath.
+	defaultTokenPath = "/var/run/secrets/openshift/serviceaccount/token"
+
+	credentialsKey = "credentials"
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// AdditionalProfile adds a profile for the role of another
+// CredentialsRequest to the credentials Secret of a CredentialsRequest.
+type AdditionalProfile struct {
+	// CredentialsRequest is the namespace/name of the CredentialsRequest
+	// whose Secret gets the profile.
+	CredentialsRequest string
+	Profile            string
+	// RoleOf is the namespace/name of the CredentialsRequest whose role the
+	// profile assumes.
+	RoleOf string
+}
+
+// ParseAdditionalProfiles parses <namespace>/<name>:<profile>=<namespace>/<name>
+// entries and checks that they refer to the CredentialsRequests.
+func ParseAdditionalProfiles(entries []string, crs []credreqs.CredentialsRequest) ([]AdditionalProfile, error) {
+	known := map[string]bool{}
+	for _, cr := range crs {
+		known[cr.NamespacedName()] = true
+	}
+
+	profiles := []AdditionalProfile{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		target := strings.SplitN(parts[0], ":", 2)
+		if len(parts) != 2 || len(target) != 2 {
+			return nil, fmt.Errorf("additional profile %q is not <namespace>/<name>:<profile>=<namespace>/<name>", entry)
+		}
+		profile := AdditionalProfile{
+			CredentialsRequest: target[0],
+			Profile:            target[1],
+			RoleOf:             parts[1],
+		}
+		if profile.Profile == "default" || !profileNamePattern.MatchString(profile.Profile) {
+			return nil, fmt.Errorf("additional profile %q has an invalid profile name", entry)
+		}
+		for _, name := range []string{profile.CredentialsRequest, profile.RoleOf} {
+			if !known[name] {
+				return nil, fmt.Errorf("additional profile %q refers to CredentialsRequest %s, which is not being processed", entry, name)
+			}
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// credentialsProfile renders a profile of the AWS shared credentials file.
+func credentialsProfile(createConfig create.Config, name, roleARN, tokenPath string) string {
+	profile := fmt.Sprintf("[%s]\nrole_arn = %s\nweb_identity_token_file = %s\n", name, roleARN, tokenPath)
+	if createConfig.STSRegionalEndpoints {
+		profile += fmt.Sprintf("sts_regional_endpoints = regional\nregion = %s\n", createConfig.Region)
+	}
+	return profile
+}
+
+// writeSecret writes the credentials Secret manifest of the
+// CredentialsRequest, with a profile for its role and the additional
+// profiles meant for it. ownerARNs maps CredentialsRequests to their role
+// ARN.
+func writeSecret(createConfig create.Config, cr credreqs.CredentialsRequest, manifestsDir, roleARN string, profiles []AdditionalProfile, ownerARNs map[string]string) {
+	tokenPath := cr.CloudTokenPath
+	if tokenPath == "" {
+		tokenPath = defaultTokenPath
+	}
+
+	credentials := credentialsProfile(createConfig, "default", roleARN, tokenPath)
+	for _, profile := range profiles {
+		if profile.CredentialsRequest != cr.NamespacedName() {
+			continue
+		}
+		credentials += "\n" + credentialsProfile(createConfig, profile.Profile, ownerARNs[profile.RoleOf], tokenPath)
+	}
+
+	// The key is written base64 encoded in data and in plain text in
+	// stringData, which takes precedence when the Secret is applied.
+	secretData := fmt.Sprintf("data:\n  %s: %s\n", credentialsKey, base64.StdEncoding.EncodeToString([]byte(credentials)))
+	secretData += fmt.Sprintf("stringData:\n  %s: |-\n", credentialsKey)
+	for _, line := range strings.Split(strings.TrimSuffix(credentials, "\n"), "\n") {
+		if line != "" {
+			line = "    " + line
+		}
+		secretData += line + "\n"
+	}
+
+	fileName := fmt.Sprintf("%s-%s-credentials.yaml", cr.Spec.SecretRef.Namespace, cr.Spec.SecretRef.Name)
+	filePath := filepath.Join(manifestsDir, fileName)
+
+	fileData := fmt.Sprintf(`apiVersion: v1
+%skind: Secret
+metadata:
+  annotations:
+    %s: %s/%s
+  name: %s
+  namespace: %s
+type: Opaque
+`, secretData, credreqv1.AnnotationCredentialsRequest, cr.Namespace, cr.Name, cr.Spec.SecretRef.Name, cr.Spec.SecretRef.Namespace)
+
+	if err := ioutil.WriteFile(filePath, []byte(fileData), 0600); err != nil {
+		log.Panicf("Failed to save Secret file: %s", err)
+	}
+
+	log.Printf("Saved credentials configuration to: %s", filePath)
+}
@@ -0,0 +1,62 @@
+package iamroles
+
+import (
+	"fmt"
+	"log"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/service/iam"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
+)
+
+// CreateForServiceAccounts reconciles the roles of the ServiceAccounts and
+// writes their ServiceAccount manifests, annotated for the pod identity
+// webhook.
+func CreateForServiceAccounts(iamClient *iam.IAM, createConfig create.Config, state *create.State, sas []podidentity.ServiceAccountRole, manifestsDir, oidcProviderARN, issuerURL string) {
+	roles := ServiceAccountRoles(createConfig, sas, oidcProviderARN, issuerURL)
+	roleARNs := createRoles(iamClient, createConfig, state, roles)
+
+	for i, sa := range sas {
+		log.Printf("Role %s ready for ServiceAccount %s", roleARNs[i], sa.NamespacedName())
+		podidentity.WriteServiceAccount(createConfig, sa, manifestsDir, roleARNs[i])
+	}
+}
+
+// ServiceAccountRoles returns the roles for the ServiceAccounts, named with
+// the role name template as if each ServiceAccount were a CredentialsRequest
+// and its target Secret.
+func ServiceAccountRoles(createConfig create.Config, sas []podidentity.ServiceAccountRole, oidcProviderARN, issuerURL string) []Role {
+	roleNameTemplate, err := template.New("role-name").Option("missingkey=error").Parse(createConfig.RoleNameTemplate)
+	if err != nil {
+		log.Panicf("failed to parse role name template: %s\n", err)
+	}
+	// role name -> namespace/name of the ServiceAccount using it
+	roleOwners := map[string]string{}
+
+	roles := []Role{}
+	for _, sa := range sas {
+		roleName := renderRoleName(roleNameTemplate, roleNameData{
+			InfraName:       createConfig.InfraName,
+			Namespace:       sa.Namespace,
+			Name:            sa.ServiceAccount,
+			SecretNamespace: sa.Namespace,
+			SecretName:      sa.ServiceAccount,
+		})
+		if existing, ok := roleOwners[roleName]; ok {
+			log.Panicf("ServiceAccounts %s and %s both map to role name %s, adjust --role-name-template", existing, sa.NamespacedName(), roleName)
+		}
+		roleOwners[roleName] = sa.NamespacedName()
+
+		roles = append(roles, Role{
+			Name:        roleName,
+			Owner:       sa.Subject(),
+			Description: fmt.Sprintf("OpenShift role for ServiceAccount %s", sa.NamespacedName()),
+			TrustPolicy: createTrustPolicy(oidcProviderARN, issuerURL, []string{sa.Subject()}),
+			Statements:  rolePolicyStatements(sa.Statements),
+		})
+	}
+
+	return roles
+}
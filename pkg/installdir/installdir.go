@@ -0,0 +1,189 @@
+package installdir
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+const (
+	installConfigFile  = "install-config.yaml"
+	installerStateFile = ".openshift_install_state.json"
+	metadataFile       = "metadata.json"
+
+	manifestsDir   = "manifests"
+	openshiftDir   = "openshift"
+	tlsDir         = "tls"
+	signingKeyFile = "bound-service-account-signing-key.key"
+
+	// rootCredentialFile is the manifest of the kube-system/aws-creds root
+	// credential, which openshift-install only leaves out in Manual mode.
+	rootCredentialFile = "99_cloud-creds-secret.yaml"
+
+	// infraIDLength is the length of the infrastructure ID openshift-install
+	// generates, of which the last infraIDRandomLength characters and the
+	// dash before them are random.
+	infraIDLength       = 27
+	infraIDRandomLength = 5
+)
+
+var (
+	infraIDInvalidChars = regexp.MustCompile("[^A-Za-z0-9-]")
+	infraIDDashes       = regexp.MustCompile(`-{2,}`)
+)
+
+// installConfig holds the install-config.yaml fields that are checked.
+type installConfig struct {
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Platform struct {
+		AWS *struct {
+			Region string `yaml:"region"`
+		} `yaml:"aws"`
+	} `yaml:"platform"`
+}
+
+// Validate checks that the install directory holds an install-config.yaml
+// that openshift-install has not consumed yet, for an AWS cluster in the
+// region of the config whose name starts the infrastructure name, and no
+// root credential manifest.
+func Validate(config create.Config, installDir string) {
+	if _, err := os.Stat(filepath.Join(installDir, metadataFile)); err == nil {
+		log.Fatalf("%s already holds a cluster, refusing to change it", installDir)
+	}
+
+	installConfigBytes, err := ioutil.ReadFile(filepath.Join(installDir, installConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(filepath.Join(installDir, installerStateFile)); err == nil {
+				log.Fatalf("openshift-install has already consumed %s in %s, refusing to change it", installConfigFile, installDir)
+			}
+		}
+		log.Fatalf("Failed to read %s: %s", installConfigFile, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(installDir, openshiftDir, rootCredentialFile)); err == nil {
+		log.Fatalf("%s holds the kube-system/aws-creds root credential manifest %s, remove it for a Manual mode cluster", installDir, filepath.Join(openshiftDir, rootCredentialFile))
+	}
+
+	var ic installConfig
+	if err := yaml.Unmarshal(installConfigBytes, &ic); err != nil {
+		log.Fatalf("Failed to parse %s: %s", installConfigFile, err)
+	}
+	if ic.Platform.AWS == nil {
+		log.Fatalf("%s is not for the AWS platform", installConfigFile)
+	}
+	if ic.Platform.AWS.Region != config.Region {
+		log.Fatalf("%s is for region %s, not --region %s", installConfigFile, ic.Platform.AWS.Region, config.Region)
+	}
+
+	prefix := infraIDPrefix(ic.Metadata.Name)
+	if !strings.HasPrefix(config.InfraName, prefix) {
+		log.Fatalf("--infra-name %s does not start with %s, which openshift-install derives from the cluster name %s in %s", config.InfraName, prefix, ic.Metadata.Name, installConfigFile)
+	}
+}
+
+// infraIDPrefix returns the part of the infrastructure ID that
+// openshift-install derives from the cluster name, normalized as it does.
+func infraIDPrefix(clusterName string) string {
+	prefix := infraIDInvalidChars.ReplaceAllString(clusterName, "-")
+	prefix = infraIDDashes.ReplaceAllString(prefix, "-")
+	if maxLength := infraIDLength - (infraIDRandomLength + 1); len(prefix) > maxLength {
+		prefix = prefix[:maxLength]
+	}
+	return strings.TrimRight(prefix, "-")
+}
+
+// Install sets credentialsMode to Manual in install-config.yaml and copies
+// the manifests and the bound service account signing key that create wrote
+// to the target directory where openshift-install expects them.
+func Install(config create.Config, installDir string) {
+	setManualCredentialsMode(filepath.Join(installDir, installConfigFile))
+
+	manifests, err := ioutil.ReadDir(filepath.Join(config.TargetDir, manifestsDir))
+	if err != nil {
+		log.Fatalf("Failed to read manifests: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(installDir, manifestsDir), 0755); err != nil {
+		log.Fatalf("Failed to create manifests directory: %s", err)
+	}
+	for _, manifest := range manifests {
+		if manifest.IsDir() {
+			continue
+		}
+		copyFile(filepath.Join(config.TargetDir, manifestsDir, manifest.Name()), filepath.Join(installDir, manifestsDir, manifest.Name()))
+	}
+
+	if err := os.MkdirAll(filepath.Join(installDir, tlsDir), 0700); err != nil {
+		log.Fatalf("Failed to create tls directory: %s", err)
+	}
+	copyFile(filepath.Join(config.TargetDir, tlsDir, signingKeyFile), filepath.Join(installDir, tlsDir, signingKeyFile))
+
+	log.Printf("Install directory %s is ready for openshift-install", installDir)
+}
+
+// setManualCredentialsMode sets credentialsMode, keeping the order of the
+// other fields.
+func setManualCredentialsMode(installConfigPath string) {
+	installConfigBytes, err := ioutil.ReadFile(installConfigPath)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %s", installConfigFile, err)
+	}
+
+	var ic yaml.MapSlice
+	if err := yaml.Unmarshal(installConfigBytes, &ic); err != nil {
+		log.Fatalf("Failed to parse %s: %s", installConfigFile, err)
+	}
+
+	found := false
+	for i, item := range ic {
+		if item.Key != "credentialsMode" {
+			continue
+		}
+		if item.Value == "Manual" {
+			return
+		}
+		ic[i].Value = "Manual"
+		found = true
+	}
+	if !found {
+		ic = append(ic, yaml.MapItem{Key: "credentialsMode", Value: "Manual"})
+	}
+
+	installConfigBytes, err = yaml.Marshal(ic)
+	if err != nil {
+		log.Fatalf("Failed to marshal %s: %s", installConfigFile, err)
+	}
+	if err := ioutil.WriteFile(installConfigPath, installConfigBytes, 0600); err != nil {
+		log.Fatalf("Failed to write %s: %s", installConfigFile, err)
+	}
+	log.Printf("credentialsMode set to Manual in %s", installConfigPath)
+}
+
+func copyFile(from, to string) {
+	in, err := os.Open(from)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %s", from, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %s", to, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		log.Fatalf("Failed to copy %s to %s: %s", from, to, err)
+	}
+	log.Printf("Copied %s", to)
+}
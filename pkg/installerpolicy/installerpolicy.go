@@ -0,0 +1,275 @@
+package installerpolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+)
+
+const (
+	// FeatureIPINetworking is for installs where openshift-install creates the
+	// VPC, subnets, gateways and route tables.
+	FeatureIPINetworking = "ipi-networking"
+	// FeatureBYOVPC is for installs into an existing VPC and subnets.
+	FeatureBYOVPC = "byo-vpc"
+	// FeaturePrivateCluster is for installs publishing only internal
+	// endpoints. Private clusters are installed into an existing VPC.
+	FeaturePrivateCluster = "private-cluster"
+)
+
+// basePermissions are needed by openshift-install to create and destroy any
+// cluster, based on the installer's own AWS permission checks.
+var basePermissions = []string{
+	"autoscaling:DescribeAutoScalingGroups",
+
+	"ec2:AllocateAddress",
+	"ec2:AssociateAddress",
+	"ec2:AttachNetworkInterface",
+	"ec2:AuthorizeSecurityGroupEgress",
+	"ec2:AuthorizeSecurityGroupIngress",
+	"ec2:CopyImage",
+	"ec2:CreateNetworkInterface",
+	"ec2:CreateSecurityGroup",
+	"ec2:CreateTags",
+	"ec2:CreateVolume",
+	"ec2:DeleteNetworkInterface",
+	"ec2:DeleteSecurityGroup",
+	"ec2:DeleteSnapshot",
+	"ec2:DeleteTags",
+	"ec2:DeleteVolume",
+	"ec2:DeregisterImage",
+	"ec2:DescribeAccountAttributes",
+	"ec2:DescribeAddresses",
+	"ec2:DescribeAvailabilityZones",
+	"ec2:DescribeDhcpOptions",
+	"ec2:DescribeImages",
+	"ec2:DescribeInstanceAttribute",
+	"ec2:DescribeInstanceCreditSpecifications",
+	"ec2:DescribeInstances",
+	"ec2:DescribeInternetGateways",
+	"ec2:DescribeKeyPairs",
+	"ec2:DescribeNatGateways",
+	"ec2:DescribeNetworkAcls",
+	"ec2:DescribeNetworkInterfaces",
+	"ec2:DescribePrefixLists",
+	"ec2:DescribeRegions",
+	"ec2:DescribeRouteTables",
+	"ec2:DescribeSecurityGroups",
+	"ec2:DescribeSubnets",
+	"ec2:DescribeTags",
+	"ec2:DescribeVolumes",
+	"ec2:DescribeVpcAttribute",
+	"ec2:DescribeVpcClassicLink",
+	"ec2:DescribeVpcClassicLinkDnsSupport",
+	"ec2:DescribeVpcEndpoints",
+	"ec2:DescribeVpcs",
+	"ec2:GetEbsDefaultKmsKeyId",
+	"ec2:ModifyInstanceAttribute",
+	"ec2:ModifyNetworkInterfaceAttribute",
+	"ec2:ReleaseAddress",
+	"ec2:RevokeSecurityGroupEgress",
+	"ec2:RevokeSecurityGroupIngress",
+	"ec2:RunInstances",
+	"ec2:TerminateInstances",
+
+	"elasticloadbalancing:AddTags",
+	"elasticloadbalancing:ApplySecurityGroupsToLoadBalancer",
+	"elasticloadbalancing:AttachLoadBalancerToSubnets",
+	"elasticloadbalancing:ConfigureHealthCheck",
+	"elasticloadbalancing:CreateListener",
+	"elasticloadbalancing:CreateLoadBalancer",
+	"elasticloadbalancing:CreateLoadBalancerListeners",
+	"elasticloadbalancing:CreateTargetGroup",
+	"elasticloadbalancing:DeleteLoadBalancer",
+	"elasticloadbalancing:DeleteTargetGroup",
+	"elasticloadbalancing:DeregisterInstancesFromLoadBalancer",
+	"elasticloadbalancing:DeregisterTargets",
+	"elasticloadbalancing:DescribeInstanceHealth",
+	"elasticloadbalancing:DescribeListeners",
+	"elasticloadbalancing:DescribeLoadBalancerAttributes",
+	"elasticloadbalancing:DescribeLoadBalancers",
+	"elasticloadbalancing:DescribeTags",
+	"elasticloadbalancing:DescribeTargetGroupAttributes",
+	"elasticloadbalancing:DescribeTargetGroups",
+	"elasticloadbalancing:DescribeTargetHealth",
+	"elasticloadbalancing:ModifyLoadBalancerAttributes",
+	"elasticloadbalancing:ModifyTargetGroup",
+	"elasticloadbalancing:ModifyTargetGroupAttributes",
+	"elasticloadbalancing:RegisterInstancesWithLoadBalancer",
+	"elasticloadbalancing:RegisterTargets",
+	"elasticloadbalancing:SetLoadBalancerPoliciesOfListener",
+
+	"iam:AddRoleToInstanceProfile",
+	"iam:CreateInstanceProfile",
+	"iam:CreateRole",
+	"iam:DeleteInstanceProfile",
+	"iam:DeleteRole",
+	"iam:DeleteRolePolicy",
+	"iam:GetInstanceProfile",
+	"iam:GetRole",
+	"iam:GetRolePolicy",
+	"iam:GetUser",
+	"iam:ListAttachedRolePolicies",
+	"iam:ListInstanceProfiles",
+	"iam:ListInstanceProfilesForRole",
+	"iam:ListRolePolicies",
+	"iam:ListRoles",
+	"iam:ListUsers",
+	"iam:PassRole",
+	"iam:PutRolePolicy",
+	"iam:RemoveRoleFromInstanceProfile",
+	"iam:SimulatePrincipalPolicy",
+	"iam:TagRole",
+
+	"route53:ChangeResourceRecordSets",
+	"route53:ChangeTagsForResource",
+	"route53:CreateHostedZone",
+	"route53:DeleteHostedZone",
+	"route53:GetChange",
+	"route53:GetHostedZone",
+	"route53:ListHostedZones",
+	"route53:ListHostedZonesByName",
+	"route53:ListResourceRecordSets",
+	"route53:ListTagsForResource",
+	"route53:UpdateHostedZoneComment",
+
+	"s3:CreateBucket",
+	"s3:DeleteBucket",
+	"s3:DeleteObject",
+	"s3:GetAccelerateConfiguration",
+	"s3:GetBucketAcl",
+	"s3:GetBucketCors",
+	"s3:GetBucketLocation",
+	"s3:GetBucketLogging",
+	"s3:GetBucketObjectLockConfiguration",
+	"s3:GetBucketReplication",
+	"s3:GetBucketRequestPayment",
+	"s3:GetBucketTagging",
+	"s3:GetBucketVersioning",
+	"s3:GetBucketWebsite",
+	"s3:GetEncryptionConfiguration",
+	"s3:GetLifecycleConfiguration",
+	"s3:GetObject",
+	"s3:GetObjectAcl",
+	"s3:GetObjectTagging",
+	"s3:GetObjectVersion",
+	"s3:GetReplicationConfiguration",
+	"s3:ListBucket",
+	"s3:ListBucketVersions",
+	"s3:PutBucketAcl",
+	"s3:PutBucketTagging",
+	"s3:PutEncryptionConfiguration",
+	"s3:PutObject",
+	"s3:PutObjectAcl",
+	"s3:PutObjectTagging",
+
+	"tag:GetResources",
+}
+
+// featurePermissions are needed on top of basePermissions for each feature.
+var featurePermissions = map[string][]string{
+	FeatureIPINetworking: {
+		"ec2:AssociateDhcpOptions",
+		"ec2:AssociateRouteTable",
+		"ec2:AttachInternetGateway",
+		"ec2:CreateDhcpOptions",
+		"ec2:CreateInternetGateway",
+		"ec2:CreateNatGateway",
+		"ec2:CreateRoute",
+		"ec2:CreateRouteTable",
+		"ec2:CreateSubnet",
+		"ec2:CreateVpc",
+		"ec2:CreateVpcEndpoint",
+		"ec2:DeleteDhcpOptions",
+		"ec2:DeleteInternetGateway",
+		"ec2:DeleteNatGateway",
+		"ec2:DeleteRoute",
+		"ec2:DeleteRouteTable",
+		"ec2:DeleteSubnet",
+		"ec2:DeleteVpc",
+		"ec2:DeleteVpcEndpoints",
+		"ec2:DetachInternetGateway",
+		"ec2:DisassociateRouteTable",
+		"ec2:ModifySubnetAttribute",
+		"ec2:ModifyVpcAttribute",
+		"ec2:ReplaceRouteTableAssociation",
+	},
+	FeatureBYOVPC: {
+		"tag:UntagResources",
+	},
+	FeaturePrivateCluster: {
+		"tag:UntagResources",
+	},
+}
+
+// Features returns the names of the supported install features.
+func Features() []string {
+	features := []string{}
+	for feature := range featurePermissions {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+type statementEntry struct {
+	Effect   string
+	Action   []string
+	Resource string
+}
+
+type policyDocument struct {
+	Version   string
+	Statement []statementEntry
+}
+
+// New returns a policy document with the minimum permissions openshift-install
+// needs for the given install features.
+func New(features []string) string {
+	actions := map[string]bool{}
+	for _, action := range basePermissions {
+		actions[action] = true
+	}
+	for _, feature := range features {
+		permissions, ok := featurePermissions[feature]
+		if !ok {
+			log.Fatalf("Unknown installer feature %q, must be one of %v", feature, Features())
+		}
+		for _, action := range permissions {
+			actions[action] = true
+		}
+	}
+
+	statement := statementEntry{
+		Effect:   "Allow",
+		Resource: "*",
+	}
+	for action := range actions {
+		statement.Action = append(statement.Action, action)
+	}
+	sort.Strings(statement.Action)
+
+	b, err := json.Marshal(&policyDocument{
+		Version:   "2012-10-17",
+		Statement: []statementEntry{statement},
+	})
+	if err != nil {
+		log.Fatalf("Failed to marshal the installer policy to JSON: %s", err)
+	}
+
+	return string(b)
+}
+
+// Validate checks that a user supplied policy document is a JSON object with
+// a Statement.
+func Validate(policy []byte) error {
+	document := map[string]interface{}{}
+	if err := json.Unmarshal(policy, &document); err != nil {
+		return fmt.Errorf("policy is not valid JSON: %s", err)
+	}
+	if _, ok := document["Statement"]; !ok {
+		return fmt.Errorf("policy has no Statement")
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package jwt
 
 import (
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -11,12 +10,18 @@ import (
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/sjenning/sts-preflight/pkg/cmd/create"
 	"github.com/sjenning/sts-preflight/pkg/cmd/token"
+	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
 )
 
 func New(config token.Config, tokenDir string) {
 	var state create.State
 	state.Read()
 
+	createConfig := create.Config{InfraName: state.InfraName, Region: state.Region}
+	if state.Config != nil {
+		createConfig = *state.Config
+	}
+
 	privateKeyPath := filepath.Join(tokenDir, "sa-signer")
 	privateKey, err := ioutil.ReadFile(privateKeyPath)
 	if err != nil {
@@ -31,7 +36,7 @@ func New(config token.Config, tokenDir string) {
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"sub": "openshift-install",
 		"aud": "openshift",
-		"iss": fmt.Sprintf("https://s3.%s.amazonaws.com/%s-installer", state.Region, state.InfraName),
+		"iss": "https://" + s3endpoint.IssuerURL(createConfig),
 		"exp": time.Now().Unix() + config.ExpireSeconds,
 		"iat": time.Now().Unix(),
 	})
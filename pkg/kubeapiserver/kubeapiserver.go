@@ -0,0 +1,108 @@
+package kubeapiserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+const (
+	outputDir = "kubernetes"
+
+	flagsFile        = "kube-apiserver-flags"
+	kubeadmFile      = "kubeadm-cluster-configuration.yaml"
+	kindConfigFile   = "kind-config.yaml"
+	privateKeyFile   = "sa-signer"
+	publicKeyFile    = "sa-signer.pub"
+	keysURI          = "keys.json"
+	pkiDir           = "/etc/kubernetes/pki"
+	signingKeyPath   = pkiDir + "/sa-signer.key"
+	verifyingKeyPath = pkiDir + "/sa-signer.pub"
+)
+
+// Write writes the kube-apiserver flags that make a plain Kubernetes cluster
+// issue ServiceAccount tokens for the issuer, signed with the generated key,
+// along with kubeadm and kind configurations that set them. The key pair is
+// expected in the control plane nodes' /etc/kubernetes/pki, which is mounted
+// into the kube-apiserver and kube-controller-manager static pods.
+func Write(config create.Config, issuerURLWithProto string) {
+	dir := filepath.Join(config.TargetDir, outputDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Panicf("Failed to create kubernetes directory: %s", err)
+	}
+
+	apiServerArgs := [][2]string{
+		{"service-account-issuer", issuerURLWithProto},
+		{"service-account-jwks-uri", fmt.Sprintf("%s/%s", issuerURLWithProto, keysURI)},
+		{"service-account-signing-key-file", signingKeyPath},
+		{"service-account-key-file", verifyingKeyPath},
+	}
+	// The controller manager signs the legacy token Secrets, which the
+	// kube-apiserver now verifies with the generated public key only.
+	controllerManagerArgs := [][2]string{
+		{"service-account-private-key-file", signingKeyPath},
+	}
+
+	flags := ""
+	for _, arg := range apiServerArgs {
+		flags += fmt.Sprintf("--%s=%s\n", arg[0], arg[1])
+	}
+	writeFile(filepath.Join(dir, flagsFile), flags)
+
+	clusterConfiguration := fmt.Sprintf(`apiVersion: kubeadm.k8s.io/v1beta3
+kind: ClusterConfiguration
+apiServer:
+  extraArgs:
+%scontrollerManager:
+  extraArgs:
+%s`, extraArgs(apiServerArgs, "    "), extraArgs(controllerManagerArgs, "    "))
+	writeFile(filepath.Join(dir, kubeadmFile), clusterConfiguration)
+
+	keyDir, err := filepath.Abs(config.TargetDir)
+	if err != nil {
+		log.Panicf("Failed to resolve %s: %s", config.TargetDir, err)
+	}
+	kindConfig := fmt.Sprintf(`kind: Cluster
+apiVersion: kind.x-k8s.io/v1alpha4
+nodes:
+- role: control-plane
+  extraMounts:
+  - hostPath: %s
+    containerPath: %s
+    readOnly: true
+  - hostPath: %s
+    containerPath: %s
+    readOnly: true
+kubeadmConfigPatches:
+- |
+  kind: ClusterConfiguration
+  apiServer:
+    extraArgs:
+%s  controllerManager:
+    extraArgs:
+%s`, filepath.Join(keyDir, privateKeyFile), signingKeyPath, filepath.Join(keyDir, publicKeyFile), verifyingKeyPath,
+		extraArgs(apiServerArgs, "      "), extraArgs(controllerManagerArgs, "      "))
+	writeFile(filepath.Join(dir, kindConfigFile), kindConfig)
+
+	log.Printf("Saved kube-apiserver flags, kubeadm and kind configurations to: %s", dir)
+}
+
+// extraArgs renders the arguments as the entries of a kubeadm extraArgs map.
+func extraArgs(args [][2]string, indent string) string {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "%s%s: %s\n", indent, arg[0], arg[1])
+	}
+	return b.String()
+}
+
+func writeFile(path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		log.Panicf("Failed to save %s: %s", path, err)
+	}
+}
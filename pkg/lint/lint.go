@@ -0,0 +1,221 @@
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is an issue found in a CredentialsRequest statement.
+type Problem struct {
+	Severity string
+	File     string
+	// CredentialsRequest is the namespace/name of the CredentialsRequest.
+	CredentialsRequest string
+	// Statement is the index of the statement in the provider spec, or -1
+	// for problems with the CredentialsRequest itself.
+	Statement int
+	Message   string
+}
+
+func (p Problem) String() string {
+	if p.Statement < 0 {
+		return fmt.Sprintf("%s: %s: %s: %s", p.Severity, p.File, p.CredentialsRequest, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s: statement %d: %s", p.Severity, p.File, p.CredentialsRequest, p.Statement, p.Message)
+}
+
+var (
+	actionPattern   = regexp.MustCompile(`^([a-z0-9-]+):([A-Za-z0-9*?]+)$`)
+	arnPattern      = regexp.MustCompile(`^arn:(aws|aws-cn|aws-us-gov|aws-iso|aws-iso-b|\*|\$\{aws:Partition\}):([a-z0-9-]*|\*):([a-z0-9-]*|\*):([0-9]{12}|\*|\$\{aws:PrincipalAccount\})?:.+$`)
+	conditionKeyPat = regexp.MustCompile(`^[A-Za-z0-9-]+:[A-Za-z0-9_/.:*-]+$`)
+
+	// knownServices are IAM action prefixes of AWS services.
+	knownServices = map[string]bool{}
+
+	// conditionOperators are the IAM condition operators without the
+	// IfExists suffix and set operator prefixes.
+	conditionOperators = map[string]bool{}
+)
+
+func init() {
+	for _, service := range []string{
+		"acm", "apigateway", "application-autoscaling", "autoscaling", "backup",
+		"cloudformation", "cloudfront", "cloudtrail", "cloudwatch", "codebuild",
+		"codecommit", "dynamodb", "ebs", "ec2", "ecr", "ecs", "efs", "eks",
+		"elasticache", "elasticfilesystem", "elasticloadbalancing", "es", "events",
+		"firehose", "glue", "iam", "kinesis", "kms", "lambda", "logs", "organizations",
+		"pricing", "rds", "redshift", "resource-groups", "route53", "route53domains",
+		"route53resolver", "s3", "secretsmanager", "servicequotas", "ses", "shield",
+		"sns", "sqs", "ssm", "sts", "tag", "waf", "waf-regional", "wafv2", "xray",
+	} {
+		knownServices[service] = true
+	}
+
+	for _, operator := range []string{
+		"StringEquals", "StringNotEquals", "StringEqualsIgnoreCase", "StringNotEqualsIgnoreCase",
+		"StringLike", "StringNotLike",
+		"NumericEquals", "NumericNotEquals", "NumericLessThan", "NumericLessThanEquals",
+		"NumericGreaterThan", "NumericGreaterThanEquals",
+		"DateEquals", "DateNotEquals", "DateLessThan", "DateLessThanEquals",
+		"DateGreaterThan", "DateGreaterThanEquals",
+		"Bool", "BinaryEquals", "IpAddress", "NotIpAddress",
+		"ArnEquals", "ArnLike", "ArnNotEquals", "ArnNotLike",
+		"Null",
+	} {
+		conditionOperators[operator] = true
+	}
+}
+
+// Lint checks every statement of the CredentialsRequests, and that their
+// ServiceAccounts can be trusted the way serviceAccountTrust says, and returns
+// the problems found.
+func Lint(crs []credreqs.CredentialsRequest, serviceAccountTrust string) []Problem {
+	problems := []Problem{}
+	for _, cr := range crs {
+		messages := []string{}
+		if serviceAccountTrust == create.ServiceAccountTrustExplicit && len(cr.ServiceAccountNames) == 0 {
+			messages = append(messages, fmt.Sprintf("no spec.serviceAccountNames to trust, list them or pass --service-account-trust %s to trust every ServiceAccount in namespace %s", create.ServiceAccountTrustWildcard, cr.Spec.SecretRef.Namespace))
+		}
+		for _, message := range messages {
+			problems = append(problems, Problem{
+				Severity:           SeverityError,
+				File:               cr.File,
+				CredentialsRequest: cr.NamespacedName(),
+				Statement:          -1,
+				Message:            message,
+			})
+		}
+
+		for i, statement := range cr.AWSProviderSpec.StatementEntries {
+			report := func(severity, format string, args ...interface{}) {
+				problems = append(problems, Problem{
+					Severity:           severity,
+					File:               cr.File,
+					CredentialsRequest: cr.NamespacedName(),
+					Statement:          i,
+					Message:            fmt.Sprintf(format, args...),
+				})
+			}
+
+			if statement.Effect != "Allow" && statement.Effect != "Deny" {
+				report(SeverityError, "effect %q must be Allow or Deny", statement.Effect)
+			}
+
+			if len(statement.Action) == 0 {
+				report(SeverityError, "no actions")
+			}
+			for _, action := range statement.Action {
+				lintAction(action, statement.Resource, report)
+			}
+
+			lintResource(statement.Resource, report)
+
+			operators := []string{}
+			for operator := range statement.PolicyCondition {
+				operators = append(operators, operator)
+			}
+			sort.Strings(operators)
+			for _, operator := range operators {
+				lintCondition(operator, statement.PolicyCondition[operator], report)
+			}
+		}
+	}
+
+	return problems
+}
+
+// Errors counts the problems with error severity.
+func Errors(problems []Problem) int {
+	errors := 0
+	for _, problem := range problems {
+		if problem.Severity == SeverityError {
+			errors++
+		}
+	}
+	return errors
+}
+
+type reportFunc func(severity, format string, args ...interface{})
+
+func lintAction(action, resource string, report reportFunc) {
+	if action == "*" || action == "*:*" {
+		report(SeverityWarning, "action %q grants every action of every service", action)
+		return
+	}
+
+	match := actionPattern.FindStringSubmatch(action)
+	if match == nil {
+		report(SeverityError, "action %q is not of the form service:Action", action)
+		return
+	}
+	service, name := match[1], match[2]
+
+	if !knownServices[service] {
+		report(SeverityWarning, "action %q has unknown service prefix %q", action, service)
+	}
+	if name == "*" {
+		report(SeverityWarning, "action %q grants every %s action", action, service)
+	}
+	if service == "iam" && strings.EqualFold(name, "PassRole") && resource == "*" {
+		report(SeverityWarning, "iam:PassRole on resource \"*\" allows passing any role")
+	}
+}
+
+func lintResource(resource string, report reportFunc) {
+	if resource == "" {
+		report(SeverityError, "no resource")
+		return
+	}
+	if resource == "*" {
+		return
+	}
+	if !arnPattern.MatchString(resource) {
+		report(SeverityError, "resource %q is not \"*\" or an ARN", resource)
+	}
+}
+
+func lintCondition(operator string, keyValues map[string]interface{}, report reportFunc) {
+	base := operator
+	for _, prefix := range []string{"ForAllValues:", "ForAnyValue:"} {
+		base = strings.TrimPrefix(base, prefix)
+	}
+	if base != "Null" {
+		base = strings.TrimSuffix(base, "IfExists")
+	}
+	if !conditionOperators[base] {
+		report(SeverityError, "unknown condition operator %q", operator)
+	}
+
+	if len(keyValues) == 0 {
+		report(SeverityError, "condition operator %q has no keys", operator)
+	}
+	keys := []string{}
+	for key := range keyValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !conditionKeyPat.MatchString(key) {
+			report(SeverityError, "condition key %q is not of the form prefix:key", key)
+		}
+		switch value := keyValues[key].(type) {
+		case string, bool, float64:
+		case []interface{}:
+			if len(value) == 0 {
+				report(SeverityError, "condition key %q has no values", key)
+			}
+		default:
+			report(SeverityError, "condition key %q has a value of type %T", key, value)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package oidcissuer
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+
+	timeout = 30 * time.Second
+)
+
+// Issuer is an externally hosted OIDC issuer.
+type Issuer struct {
+	// URL is the issuer URL without the https:// prefix, as IAM names OIDC
+	// providers.
+	URL     string
+	JWKSURI string
+	// Thumbprint is the SHA-1 fingerprint of the top certificate in the
+	// chain the JWKS host serves, which IAM uses to verify it.
+	Thumbprint string
+}
+
+// discoveryDocument holds the discovery document fields that are checked.
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// Discover reads the discovery document and JWKS of the issuer, checks that
+// they can be used to verify ServiceAccount tokens and computes the
+// thumbprint of the JWKS host. Requests go through the proxy of the
+// HTTPS_PROXY and NO_PROXY environment, trusting the certificates in
+// caBundleFile besides the system roots.
+func Discover(issuerURL, caBundleFile string) (Issuer, error) {
+	issuerURL = strings.TrimSuffix(issuerURL, "/")
+	u, err := url.Parse(issuerURL)
+	if err != nil {
+		return Issuer{}, fmt.Errorf("invalid issuer URL %q: %s", issuerURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return Issuer{}, fmt.Errorf("issuer URL %q must be https:// without a query or fragment", issuerURL)
+	}
+
+	roots, err := awssession.RootCAs(caBundleFile)
+	if err != nil {
+		return Issuer{}, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	httpClient := &http.Client{Timeout: timeout, Transport: transport}
+
+	var discovery discoveryDocument
+	if err := getJSON(httpClient, issuerURL+discoveryPath, &discovery); err != nil {
+		return Issuer{}, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuerURL {
+		return Issuer{}, fmt.Errorf("discovery document of %s names issuer %q", issuerURL, discovery.Issuer)
+	}
+	jwksURL, err := url.Parse(discovery.JWKSURI)
+	if err != nil || jwksURL.Scheme != "https" || jwksURL.Host == "" {
+		return Issuer{}, fmt.Errorf("discovery document of %s has jwks_uri %q, which is not an https URL", issuerURL, discovery.JWKSURI)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := getJSON(httpClient, discovery.JWKSURI, &keySet); err != nil {
+		return Issuer{}, err
+	}
+	signingKeys := 0
+	for _, key := range keySet.Keys {
+		if !key.Valid() || !key.IsPublic() {
+			return Issuer{}, fmt.Errorf("JWKS at %s holds key %q, which is not a valid public key", discovery.JWKSURI, key.KeyID)
+		}
+		if key.Use == "" || key.Use == "sig" {
+			signingKeys++
+		}
+	}
+	if signingKeys == 0 {
+		return Issuer{}, fmt.Errorf("JWKS at %s holds no signing keys", discovery.JWKSURI)
+	}
+
+	thumbprint, err := thumbprint(jwksURL, roots, caBundleFile != "")
+	if err != nil {
+		return Issuer{}, err
+	}
+
+	log.Printf("Issuer %s serves %d signing keys at %s, thumbprint %s", issuerURL, signingKeys, discovery.JWKSURI, thumbprint)
+	return Issuer{
+		URL:        strings.TrimPrefix(issuerURL, "https://"),
+		JWKSURI:    discovery.JWKSURI,
+		Thumbprint: thumbprint,
+	}, nil
+}
+
+func getJSON(httpClient *http.Client, u string, v interface{}) error {
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", u, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", u, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %s", u, err)
+	}
+	return nil
+}
+
+// Thumbprint returns the thumbprint IAM needs for an issuer whose JWKS is
+// served from host, such as the regional S3 host of a bucket.
+func Thumbprint(host, caBundleFile string) (string, error) {
+	roots, err := awssession.RootCAs(caBundleFile)
+	if err != nil {
+		return "", err
+	}
+	return thumbprint(&url.URL{Scheme: "https", Host: host}, roots, caBundleFile != "")
+}
+
+// thumbprint returns the SHA-1 fingerprint of the last certificate in the
+// chain served by the host of u, the way IAM computes it. When the chain is
+// only trusted thanks to the CA bundle, a proxy is likely intercepting TLS
+// and the thumbprint is not the one IAM will see.
+func thumbprint(u *url.URL, roots *x509.CertPool, caBundle bool) (string, error) {
+	conn, err := dial(u, roots)
+	if err != nil {
+		return "", err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), RootCAs: roots})
+	defer tlsConn.Close()
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake with %s failed: %s", u.Host, err)
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("%s served no certificates", u.Host)
+	}
+	if caBundle && !systemTrusted(u.Hostname(), certs) {
+		log.Printf("Warning: the certificate chain of %s is only trusted through the CA bundle; if a proxy intercepts TLS, the computed thumbprint is that of its CA and IAM will not accept the issuer", u.Host)
+	}
+	return fmt.Sprintf("%X", sha1.Sum(certs[len(certs)-1].Raw)), nil
+}
+
+// systemTrusted returns whether the system roots trust the served chain.
+func systemTrusted(hostname string, certs []*x509.Certificate) bool {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{DNSName: hostname, Roots: roots, Intermediates: intermediates})
+	return err == nil
+}
+
+// dial connects to the host of u, tunneling through the proxy the
+// environment names for u, if any.
+func dial(u *url.URL, roots *x509.CertPool) (net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy configuration: %s", err)
+	}
+	if proxyURL == nil {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", addr, err)
+		}
+		return conn, nil
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %s", proxyAddr, err)
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), RootCAs: roots})
+	}
+
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to tunnel to %s through proxy %s: %s", addr, proxyAddr, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to tunnel to %s through proxy %s: %s", addr, proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused the tunnel to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
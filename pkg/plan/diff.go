@@ -0,0 +1,98 @@
+package plan
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// policyDiff describes the change from the current to the desired policy
+// document. Either may be empty.
+func policyDiff(name, current, desired string) PolicyDiff {
+	currentJSON := normalize(current)
+	desiredJSON := normalize(desired)
+
+	return PolicyDiff{
+		Name:    name,
+		Current: rawOrNil(currentJSON),
+		Desired: rawOrNil(desiredJSON),
+		Diff:    lineDiff(currentJSON, desiredJSON),
+	}
+}
+
+// normalize returns the policy document, which may be URL encoded as returned
+// by the IAM API, indented with sorted keys.
+func normalize(document string) string {
+	if document == "" {
+		return ""
+	}
+	if decoded, err := url.QueryUnescape(document); err == nil {
+		document = decoded
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(document), &v); err != nil {
+		return document
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return document
+	}
+	return string(b)
+}
+
+func rawOrNil(document string) json.RawMessage {
+	if document == "" || !json.Valid([]byte(document)) {
+		return nil
+	}
+	return json.RawMessage(document)
+}
+
+// lineDiff returns a unified style diff of the lines of a and b, without
+// hunk headers.
+func lineDiff(a, b string) string {
+	var aLines, bLines []string
+	if a != "" {
+		aLines = strings.Split(a, "\n")
+	}
+	if b != "" {
+		bLines = strings.Split(b, "\n")
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// aLines[i:] and bLines[j:].
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("--- current\n+++ desired\n")
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			out.WriteString("  " + aLines[i] + "\n")
+			i++
+			j++
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			out.WriteString("+ " + bLines[j] + "\n")
+			j++
+		default:
+			out.WriteString("- " + aLines[i] + "\n")
+			i++
+		}
+	}
+	return out.String()
+}
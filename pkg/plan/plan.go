@@ -0,0 +1,553 @@
+package plan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
+	"github.com/sjenning/sts-preflight/pkg/iamroles"
+	"github.com/sjenning/sts-preflight/pkg/oidcissuer"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
+	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
+)
+
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+	// ActionConflict means the resource exists but cannot be taken over,
+	// for example a bucket owned by another account.
+	ActionConflict = "conflict"
+)
+
+// Change is what create would do to one resource.
+type Change struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Details describe each difference found.
+	Details     []string     `json:"details,omitempty"`
+	PolicyDiffs []PolicyDiff `json:"policyDiffs,omitempty"`
+}
+
+// PolicyDiff is the difference between the current and desired version of a
+// policy document. Current is empty for policies that do not exist yet, and
+// Desired is empty for policies that would be removed.
+type PolicyDiff struct {
+	Name    string          `json:"name"`
+	Current json.RawMessage `json:"current,omitempty"`
+	Desired json.RawMessage `json:"desired,omitempty"`
+	Diff    string          `json:"diff"`
+}
+
+// Plan lists the changes for every resource create manages.
+type Plan struct {
+	Changes []Change `json:"changes"`
+}
+
+// Pending reports whether the plan contains anything but unchanged
+// resources.
+func (p Plan) Pending() bool {
+	for _, change := range p.Changes {
+		if change.Action != ActionUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the plan in human readable form.
+func (p Plan) Print(w io.Writer) {
+	counts := map[string]int{}
+	for _, change := range p.Changes {
+		counts[change.Action]++
+		fmt.Fprintf(w, "%s %s: %s\n", change.Kind, change.Name, change.Action)
+		for _, detail := range change.Details {
+			fmt.Fprintf(w, "  %s\n", detail)
+		}
+		for _, diff := range change.PolicyDiffs {
+			fmt.Fprintf(w, "  %s:\n", diff.Name)
+			for _, line := range strings.Split(strings.TrimSuffix(diff.Diff, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d to create, %d to update, %d unchanged, %d conflicts\n",
+		counts[ActionCreate], counts[ActionUpdate], counts[ActionUnchanged], counts[ActionConflict])
+}
+
+// PrintJSON writes the plan as JSON.
+func (p Plan) PrintJSON(w io.Writer) {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		log.Panicf("Failed to marshal plan: %s", err)
+	}
+	fmt.Fprintln(w, string(b))
+}
+
+type planner struct {
+	config    create.Config
+	state     *create.State
+	s3Client  *s3.S3
+	iamClient *iam.IAM
+	partition string
+	accountID string
+	plan      Plan
+}
+
+// New compares the resources create would manage with what exists in AWS,
+// without changing anything, not even generating keys. The JWKS is read from
+// the target directory; if create has not generated it yet, keys.json is
+// planned as a new document. The state of earlier runs tells which installer
+// policies create attached.
+func New(config create.Config, state *create.State, crs []credreqs.CredentialsRequest, sas []podidentity.ServiceAccountRole) Plan {
+	s, err := awssession.New(config)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+
+	identity, err := sts.New(s).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	callerARN, err := arn.Parse(awssdk.StringValue(identity.Arn))
+	if err != nil {
+		log.Panic(err.Error())
+	}
+
+	p := &planner{
+		config:    config,
+		state:     state,
+		s3Client:  s3.New(s),
+		iamClient: iam.New(s),
+		partition: callerARN.Partition,
+		accountID: awssdk.StringValue(identity.Account),
+	}
+
+	bucketName := s3endpoint.BucketName(config)
+	issuerURL := s3endpoint.IssuerURL(config)
+
+	var thumbprint string
+	if config.ExternalIssuerURL != "" {
+		issuer, err := oidcissuer.Discover(config.ExternalIssuerURL, config.CABundle)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		thumbprint = issuer.Thumbprint
+	} else {
+		thumbprint, err = s3endpoint.S3Thumbprint(config)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+
+		bucketExists := p.bucket(bucketName)
+
+		keysJSON, err := ioutil.ReadFile(filepath.Join(config.TargetDir, s3endpoint.KeysURI))
+		if err != nil && !os.IsNotExist(err) {
+			log.Panic(err.Error())
+		}
+		p.object(bucketName, s3endpoint.DiscoveryURI, []byte(s3endpoint.DiscoveryDocument("https://"+issuerURL)), bucketExists)
+		p.object(bucketName, s3endpoint.KeysURI, keysJSON, bucketExists)
+	}
+
+	providerARN := p.oidcProvider(issuerURL, thumbprint)
+
+	policyARNs, inlinePolicies := s3endpoint.InstallerPermissions(config)
+	p.role(roleSpec{
+		name:                s3endpoint.InstallerRoleName(config),
+		trustPolicy:         s3endpoint.InstallerTrustPolicy(providerARN, issuerURL),
+		inlinePolicies:      inlinePolicies,
+		ownedInlinePolicies: s3endpoint.InstallerInlinePolicyNames,
+		attached:            policyARNs,
+		ownsAttached: func(policyARN, policyName string) bool {
+			return s3endpoint.OwnsInstallerPolicy(config, state.InstallerPolicyARNs, policyARN)
+		},
+	})
+
+	roles := iamroles.AdoptLegacyRoleNames(p.iamClient, iamroles.DesiredRoles(config, crs, providerARN, issuerURL))
+	roles = append(roles, iamroles.ServiceAccountRoles(config, sas, providerARN, issuerURL)...)
+	for _, role := range roles {
+		inline, managed := role.Policies()
+		spec := roleSpec{
+			name:                role.Name,
+			owner:               role.Owner,
+			trustPolicy:         role.TrustPolicy,
+			inlinePolicies:      map[string]string{},
+			ownedInlinePolicies: []string{role.Name},
+			managedPolicies:     map[string]string{},
+			ownsAttached: func(policyARN, policyName string) bool {
+				return strings.HasPrefix(policyName, role.Name+"-")
+			},
+		}
+		if inline != "" {
+			spec.inlinePolicies[role.Name] = inline
+		}
+		for i, document := range managed {
+			policyARN := p.policyARN(iamroles.ManagedPolicyName(role.Name, i))
+			spec.managedPolicies[policyARN] = document
+			spec.attached = append(spec.attached, policyARN)
+		}
+		p.role(spec)
+	}
+
+	return p.plan
+}
+
+func (p *planner) add(change Change) {
+	if change.Action == "" {
+		if len(change.Details) > 0 || len(change.PolicyDiffs) > 0 {
+			change.Action = ActionUpdate
+		} else {
+			change.Action = ActionUnchanged
+		}
+	}
+	p.plan.Changes = append(p.plan.Changes, change)
+}
+
+func (p *planner) policyARN(policyName string) string {
+	return arn.ARN{
+		Partition: p.partition,
+		Service:   "iam",
+		AccountID: p.accountID,
+		Resource:  fmt.Sprintf("policy%s%s", p.config.RolePath, policyName),
+	}.String()
+}
+
+func (p *planner) bucket(bucketName string) bool {
+	change := Change{Kind: create.KindBucket, Name: bucketName}
+
+	_, err := p.s3Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) {
+			log.Panic(err.Error())
+		}
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchBucket:
+			change.Action = ActionCreate
+			p.add(change)
+			return false
+		case "Forbidden":
+			change.Action = ActionConflict
+			change.Details = append(change.Details, "bucket exists and is owned by another account")
+			p.add(change)
+			return false
+		default:
+			log.Panic(err.Error())
+		}
+	}
+
+	current := map[string]string{}
+	tagging, err := p.s3Client.GetBucketTagging(&s3.GetBucketTaggingInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == "NoSuchTagSet") {
+			log.Panic(err.Error())
+		}
+	} else {
+		for _, tag := range tagging.TagSet {
+			current[awssdk.StringValue(tag.Key)] = awssdk.StringValue(tag.Value)
+		}
+	}
+	if merged := s3endpoint.MergedBucketTags(current, p.config.ResourceTags()); !reflect.DeepEqual(current, merged) {
+		change.Details = append(change.Details, fmt.Sprintf("tags %v need updating", sortedKeys(changedTags(current, merged))))
+	}
+	settings, err := s3endpoint.BucketSettingsDiff(p.s3Client, p.config, bucketName)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	change.Details = append(change.Details, settings...)
+
+	p.add(change)
+	return true
+}
+
+// object plans the object. Nil content stands for a document create has yet
+// to generate.
+func (p *planner) object(bucketName, key string, content []byte, bucketExists bool) {
+	change := Change{Kind: create.KindObject, Name: fmt.Sprintf("%s/%s", bucketName, key)}
+	if !bucketExists {
+		change.Action = ActionCreate
+		p.add(change)
+		return
+	}
+
+	head, err := p.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: awssdk.String(bucketName),
+		Key:    awssdk.String(key),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == "NotFound") {
+			log.Panic(err.Error())
+		}
+		change.Action = ActionCreate
+	} else if content == nil {
+		change.Details = append(change.Details, fmt.Sprintf("%s is not in %s yet, create generates a new key pair and replaces it", key, p.config.TargetDir))
+	} else if !s3endpoint.ObjectUpToDate(head, content) {
+		change.Details = append(change.Details, "content or headers differ")
+	}
+
+	p.add(change)
+}
+
+// oidcProvider plans the OIDC provider and returns its existing or future
+// ARN.
+func (p *planner) oidcProvider(issuerURL, thumbprint string) string {
+	providerARN := arn.ARN{
+		Partition: p.partition,
+		Service:   "iam",
+		AccountID: p.accountID,
+		Resource:  "oidc-provider/" + issuerURL,
+	}.String()
+	change := Change{Kind: create.KindOIDCProvider, Name: providerARN}
+
+	provider, err := p.iamClient.GetOpenIDConnectProvider(&iam.GetOpenIDConnectProviderInput{
+		OpenIDConnectProviderArn: awssdk.String(providerARN),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+			log.Panic(err.Error())
+		}
+		change.Action = ActionCreate
+		p.add(change)
+		return providerARN
+	}
+
+	if clientIDs := awssdk.StringValueSlice(provider.ClientIDList); !reflect.DeepEqual(clientIDs, []string{s3endpoint.OIDCClientID}) {
+		change.Details = append(change.Details, fmt.Sprintf("client IDs %v differ from [%s]", clientIDs, s3endpoint.OIDCClientID))
+	}
+	if thumbprints := awssdk.StringValueSlice(provider.ThumbprintList); len(thumbprints) != 1 || !strings.EqualFold(thumbprints[0], thumbprint) {
+		change.Details = append(change.Details, fmt.Sprintf("thumbprints %v differ from [%s]", thumbprints, thumbprint))
+	}
+	if tags := iamroles.ChangedTags(provider.Tags, p.config.ResourceTags()); len(tags) > 0 {
+		change.Details = append(change.Details, fmt.Sprintf("tags %v need updating", tagKeys(tags)))
+	}
+
+	p.add(change)
+	return providerARN
+}
+
+// roleSpec is the desired configuration of a role.
+type roleSpec struct {
+	name        string
+	trustPolicy string
+	// owner is the CredentialsRequest of the role, empty for the installer
+	// role.
+	owner string
+	// inlinePolicies are the desired inline policies by name.
+	inlinePolicies map[string]string
+	// ownedInlinePolicies are the inline policies create manages.
+	ownedInlinePolicies []string
+	// attached are the desired attached managed policy ARNs.
+	attached []string
+	// ownsAttached reports whether create manages an attached policy.
+	ownsAttached func(policyARN, policyName string) bool
+	// managedPolicies are the documents of customer managed policies create
+	// maintains for the role, by ARN.
+	managedPolicies map[string]string
+}
+
+func (p *planner) role(spec roleSpec) {
+	change := Change{Kind: create.KindRole, Name: spec.name}
+
+	roleOutput, err := p.iamClient.GetRole(&iam.GetRoleInput{
+		RoleName: awssdk.String(spec.name),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+			log.Panic(err.Error())
+		}
+		change.Action = ActionCreate
+		change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("trust policy", "", spec.trustPolicy))
+		for _, name := range sortedKeys(spec.inlinePolicies) {
+			change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("inline policy "+name, "", spec.inlinePolicies[name]))
+		}
+		for _, policyARN := range sortedKeys(spec.managedPolicies) {
+			change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("managed policy "+policyARN, "", spec.managedPolicies[policyARN]))
+		}
+		for _, policyARN := range spec.attached {
+			change.Details = append(change.Details, "attach "+policyARN)
+		}
+		p.add(change)
+		return
+	}
+	role := roleOutput.Role
+
+	if spec.owner != "" {
+		for _, tag := range role.Tags {
+			if awssdk.StringValue(tag.Key) == iamroles.CredentialsRequestTagKey && awssdk.StringValue(tag.Value) != spec.owner {
+				change.Action = ActionConflict
+				change.Details = append(change.Details, fmt.Sprintf("role belongs to CredentialsRequest %s, not %s", awssdk.StringValue(tag.Value), spec.owner))
+				p.add(change)
+				return
+			}
+		}
+	}
+
+	current := awssdk.StringValue(role.AssumeRolePolicyDocument)
+	if !iamroles.PolicyDocumentsEqual(current, spec.trustPolicy) {
+		change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("trust policy", current, spec.trustPolicy))
+	}
+
+	if awssdk.StringValue(role.Path) != p.config.RolePath {
+		change.Details = append(change.Details, fmt.Sprintf("path %s differs from %s and can only be changed by recreating the role", awssdk.StringValue(role.Path), p.config.RolePath))
+	}
+	if awssdk.Int64Value(role.MaxSessionDuration) != p.config.MaxSessionDuration {
+		change.Details = append(change.Details, fmt.Sprintf("maximum session duration %d differs from %d", awssdk.Int64Value(role.MaxSessionDuration), p.config.MaxSessionDuration))
+	}
+	var boundary string
+	if role.PermissionsBoundary != nil {
+		boundary = awssdk.StringValue(role.PermissionsBoundary.PermissionsBoundaryArn)
+	}
+	if boundary != p.config.PermissionsBoundaryARN {
+		change.Details = append(change.Details, fmt.Sprintf("permissions boundary %q differs from %q", boundary, p.config.PermissionsBoundaryARN))
+	}
+	if tags := iamroles.ChangedTags(role.Tags, p.config.ResourceTags()); len(tags) > 0 {
+		change.Details = append(change.Details, fmt.Sprintf("tags %v need updating", tagKeys(tags)))
+	}
+
+	for _, name := range spec.ownedInlinePolicies {
+		desired, wanted := spec.inlinePolicies[name]
+		policy, err := p.iamClient.GetRolePolicy(&iam.GetRolePolicyInput{
+			PolicyName: awssdk.String(name),
+			RoleName:   awssdk.String(spec.name),
+		})
+		if err != nil {
+			var aerr awserr.Error
+			if !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+				log.Panic(err.Error())
+			}
+			if wanted {
+				change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("inline policy "+name, "", desired))
+			}
+			continue
+		}
+
+		current := awssdk.StringValue(policy.PolicyDocument)
+		if !wanted {
+			change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("inline policy "+name, current, ""))
+		} else if !iamroles.PolicyDocumentsEqual(current, desired) {
+			change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("inline policy "+name, current, desired))
+		}
+	}
+
+	attached := map[string]string{}
+	err = p.iamClient.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{
+		RoleName: awssdk.String(spec.name),
+	}, func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.AttachedPolicies {
+			attached[awssdk.StringValue(policy.PolicyArn)] = awssdk.StringValue(policy.PolicyName)
+		}
+		return true
+	})
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	for _, policyARN := range sortedKeys(attached) {
+		if !containsString(spec.attached, policyARN) && spec.ownsAttached(policyARN, attached[policyARN]) {
+			change.Details = append(change.Details, "detach "+policyARN)
+		}
+	}
+	for _, policyARN := range spec.attached {
+		if _, ok := attached[policyARN]; !ok {
+			change.Details = append(change.Details, "attach "+policyARN)
+		}
+	}
+
+	for _, policyARN := range sortedKeys(spec.managedPolicies) {
+		desired := spec.managedPolicies[policyARN]
+		current := p.managedPolicyDocument(policyARN)
+		if !iamroles.PolicyDocumentsEqual(current, desired) {
+			change.PolicyDiffs = append(change.PolicyDiffs, policyDiff("managed policy "+policyARN, current, desired))
+		}
+	}
+
+	p.add(change)
+}
+
+// managedPolicyDocument returns the default version of the managed policy,
+// or "" if it does not exist.
+func (p *planner) managedPolicyDocument(policyARN string) string {
+	policy, err := p.iamClient.GetPolicy(&iam.GetPolicyInput{
+		PolicyArn: awssdk.String(policyARN),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return ""
+		}
+		log.Panic(err.Error())
+	}
+
+	version, err := p.iamClient.GetPolicyVersion(&iam.GetPolicyVersionInput{
+		PolicyArn: awssdk.String(policyARN),
+		VersionId: policy.Policy.DefaultVersionId,
+	})
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	return awssdk.StringValue(version.PolicyVersion.Document)
+}
+
+func tagKeys(tags []*iam.Tag) []string {
+	keys := []string{}
+	for _, tag := range tags {
+		keys = append(keys, awssdk.StringValue(tag.Key))
+	}
+	return keys
+}
+
+// changedTags returns the tags of wanted that current lacks or holds with
+// another value.
+func changedTags(current, wanted map[string]string) map[string]string {
+	changed := map[string]string{}
+	for k, v := range wanted {
+		if value, ok := current[k]; !ok || value != v {
+			changed[k] = v
+		}
+	}
+	return changed
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
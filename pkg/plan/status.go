@@ -0,0 +1,85 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+const (
+	StatusInSync   = "in-sync"
+	StatusMissing  = "missing"
+	StatusDrifted  = "drifted"
+	StatusConflict = "conflict"
+)
+
+// ResourceStatus is how far one resource has drifted from what create
+// configured.
+type ResourceStatus struct {
+	Kind        string       `json:"kind"`
+	Name        string       `json:"name"`
+	Status      string       `json:"status"`
+	Details     []string     `json:"details,omitempty"`
+	PolicyDiffs []PolicyDiff `json:"policyDiffs,omitempty"`
+}
+
+// Status reports drift for every resource create manages.
+type Status struct {
+	Drifted   bool             `json:"drifted"`
+	Resources []ResourceStatus `json:"resources"`
+}
+
+// Status turns the plan into a drift report: resources create would create
+// are missing and resources it would update have drifted.
+func (p Plan) Status() Status {
+	statuses := map[string]string{
+		ActionCreate:    StatusMissing,
+		ActionUpdate:    StatusDrifted,
+		ActionUnchanged: StatusInSync,
+		ActionConflict:  StatusConflict,
+	}
+
+	status := Status{Drifted: p.Pending(), Resources: []ResourceStatus{}}
+	for _, change := range p.Changes {
+		status.Resources = append(status.Resources, ResourceStatus{
+			Kind:        change.Kind,
+			Name:        change.Name,
+			Status:      statuses[change.Action],
+			Details:     change.Details,
+			PolicyDiffs: change.PolicyDiffs,
+		})
+	}
+	return status
+}
+
+// Print writes the drift report in human readable form.
+func (s Status) Print(w io.Writer) {
+	drifted := 0
+	for _, resource := range s.Resources {
+		if resource.Status != StatusInSync {
+			drifted++
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", resource.Kind, resource.Name, resource.Status)
+		for _, detail := range resource.Details {
+			fmt.Fprintf(w, "  %s\n", detail)
+		}
+		for _, diff := range resource.PolicyDiffs {
+			fmt.Fprintf(w, "  %s:\n", diff.Name)
+			for _, line := range strings.Split(strings.TrimSuffix(diff.Diff, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d of %d resources drifted\n", drifted, len(s.Resources))
+}
+
+// PrintJSON writes the drift report as JSON.
+func (s Status) PrintJSON(w io.Writer) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Panicf("Failed to marshal status: %s", err)
+	}
+	fmt.Fprintln(w, string(b))
+}
@@ -0,0 +1,113 @@
+package podidentity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	credreqv1 "github.com/openshift/cloud-credential-operator/pkg/apis/cloudcredential/v1"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+const (
+	// Audience is the token audience the roles trust and the webhook
+	// requests tokens for.
+	Audience = "openshift"
+
+	// annotationPrefix is what the webhook looks for on ServiceAccounts.
+	annotationPrefix = "eks.amazonaws.com"
+)
+
+// ServiceAccountRole is a ServiceAccount that gets a role of its own, outside
+// the CredentialsRequest flow.
+type ServiceAccountRole struct {
+	Namespace      string                     `json:"namespace"`
+	ServiceAccount string                     `json:"serviceAccount"`
+	Statements     []credreqv1.StatementEntry `json:"statements"`
+}
+
+// NamespacedName returns namespace/name of the ServiceAccount.
+func (r ServiceAccountRole) NamespacedName() string {
+	return fmt.Sprintf("%s/%s", r.Namespace, r.ServiceAccount)
+}
+
+// Subject returns the token subject of the ServiceAccount.
+func (r ServiceAccountRole) Subject() string {
+	return fmt.Sprintf("system:serviceaccount:%s:%s", r.Namespace, r.ServiceAccount)
+}
+
+// Load reads the YAML or JSON list of ServiceAccount roles in the config's
+// ServiceAccountRolesFile.
+func Load(createConfig create.Config) []ServiceAccountRole {
+	f, err := os.Open(createConfig.ServiceAccountRolesFile)
+	if err != nil {
+		log.Fatalf("Failed to open ServiceAccount roles file: %s", err)
+	}
+	defer f.Close()
+
+	roles := []ServiceAccountRole{}
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&roles); err != nil {
+		log.Fatalf("Failed to decode %s: %s", createConfig.ServiceAccountRolesFile, err)
+	}
+
+	seen := map[string]bool{}
+	for i, role := range roles {
+		for _, msg := range validation.IsDNS1123Label(role.Namespace) {
+			log.Fatalf("ServiceAccount role %d: namespace %q: %s", i, role.Namespace, msg)
+		}
+		for _, msg := range validation.IsDNS1123Subdomain(role.ServiceAccount) {
+			log.Fatalf("ServiceAccount role %d: serviceAccount %q: %s", i, role.ServiceAccount, msg)
+		}
+		if seen[role.NamespacedName()] {
+			log.Fatalf("ServiceAccount %s is listed more than once", role.NamespacedName())
+		}
+		seen[role.NamespacedName()] = true
+
+		if len(role.Statements) == 0 {
+			log.Fatalf("ServiceAccount %s has no statements", role.NamespacedName())
+		}
+		for j, statement := range role.Statements {
+			if statement.Effect != "Allow" && statement.Effect != "Deny" {
+				log.Fatalf("ServiceAccount %s statement %d: effect %q must be Allow or Deny", role.NamespacedName(), j, statement.Effect)
+			}
+			if len(statement.Action) == 0 || statement.Resource == "" {
+				log.Fatalf("ServiceAccount %s statement %d needs an action and a resource", role.NamespacedName(), j)
+			}
+		}
+	}
+
+	log.Printf("Read %d ServiceAccount roles from %s", len(roles), createConfig.ServiceAccountRolesFile)
+	return roles
+}
+
+// WriteServiceAccount writes the ServiceAccount manifest annotated with the
+// role that the webhook makes its pods assume.
+func WriteServiceAccount(createConfig create.Config, role ServiceAccountRole, manifestsDir, roleARN string) {
+	annotations := fmt.Sprintf("    %s/audience: %s\n    %s/role-arn: %s\n", annotationPrefix, Audience, annotationPrefix, roleARN)
+	if createConfig.STSRegionalEndpoints {
+		annotations += fmt.Sprintf("    %s/sts-regional-endpoints: \"true\"\n", annotationPrefix)
+	}
+
+	fileName := fmt.Sprintf("%s-%s-serviceaccount.yaml", role.Namespace, role.ServiceAccount)
+	filePath := filepath.Join(manifestsDir, fileName)
+
+	fileData := fmt.Sprintf(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  annotations:
+%s  name: %s
+  namespace: %s
+`, annotations, role.ServiceAccount, role.Namespace)
+
+	if err := ioutil.WriteFile(filePath, []byte(fileData), 0600); err != nil {
+		log.Panicf("Failed to save ServiceAccount file: %s", err)
+	}
+
+	log.Printf("Saved ServiceAccount configuration to: %s", filePath)
+}
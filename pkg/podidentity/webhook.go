@@ -0,0 +1,201 @@
+package podidentity
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+)
+
+const (
+	// DefaultWebhookImage is the pod identity webhook image deployed unless
+	// the config names another.
+	DefaultWebhookImage = "amazon/amazon-eks-pod-identity-webhook:latest"
+
+	webhookName      = "pod-identity-webhook"
+	webhookNamespace = "pod-identity-webhook"
+	webhookPort      = 9443
+	webhookCertDir   = "/var/run/app/certs"
+)
+
+// The serving certificate of the webhook comes from the OpenShift service CA,
+// which also injects its bundle into the MutatingWebhookConfiguration.
+var webhookManifests = []struct {
+	file     string
+	template string
+}{
+	{"pod-identity-webhook-00-namespace.yaml", `apiVersion: v1
+kind: Namespace
+metadata:
+  name: {{.Namespace}}
+`},
+	{"pod-identity-webhook-01-serviceaccount.yaml", `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+`},
+	{"pod-identity-webhook-02-clusterrole.yaml", `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{.Name}}
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - serviceaccounts
+  verbs:
+  - get
+  - list
+  - watch
+`},
+	{"pod-identity-webhook-03-clusterrolebinding.yaml", `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{.Name}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{.Name}}
+subjects:
+- kind: ServiceAccount
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+`},
+	{"pod-identity-webhook-04-service.yaml", `apiVersion: v1
+kind: Service
+metadata:
+  annotations:
+    service.beta.openshift.io/serving-cert-secret-name: {{.Name}}
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+spec:
+  ports:
+  - port: 443
+    targetPort: {{.Port}}
+  selector:
+    app: {{.Name}}
+`},
+	{"pod-identity-webhook-05-deployment.yaml", `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{.Name}}
+  template:
+    metadata:
+      labels:
+        app: {{.Name}}
+    spec:
+      serviceAccountName: {{.Name}}
+      containers:
+      - name: {{.Name}}
+        image: {{.Image}}
+        command:
+        - /webhook
+        - --in-cluster=false
+        - --namespace={{.Namespace}}
+        - --service-name={{.Name}}
+        - --annotation-prefix={{.AnnotationPrefix}}
+        - --token-audience={{.Audience}}
+        - --aws-default-region={{.Region}}
+        - --sts-regional-endpoint={{.STSRegionalEndpoints}}
+        - --port={{.Port}}
+        - --tls-cert={{.CertDir}}/tls.crt
+        - --tls-key={{.CertDir}}/tls.key
+        - --logtostderr
+        volumeMounts:
+        - name: cert
+          mountPath: {{.CertDir}}
+          readOnly: true
+      volumes:
+      - name: cert
+        secret:
+          secretName: {{.Name}}
+`},
+	{"pod-identity-webhook-06-mutatingwebhookconfiguration.yaml", `apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  annotations:
+    service.beta.openshift.io/inject-cabundle: "true"
+  name: {{.Name}}
+webhooks:
+- name: {{.Name}}.amazonaws.com
+  admissionReviewVersions:
+  - v1beta1
+  clientConfig:
+    service:
+      name: {{.Name}}
+      namespace: {{.Namespace}}
+      path: /mutate
+  failurePolicy: Ignore
+  rules:
+  - apiGroups:
+    - ""
+    apiVersions:
+    - v1
+    operations:
+    - CREATE
+    resources:
+    - pods
+  sideEffects: None
+`},
+}
+
+// webhookData are the fields available to the webhook manifest templates.
+type webhookData struct {
+	Name                 string
+	Namespace            string
+	Image                string
+	AnnotationPrefix     string
+	Audience             string
+	Region               string
+	STSRegionalEndpoints bool
+	Port                 int
+	CertDir              string
+}
+
+// WriteWebhook writes the manifests deploying the pod identity webhook, which
+// gives pods of annotated ServiceAccounts a token for the issuer's audience
+// and the environment to assume their role with it.
+func WriteWebhook(createConfig create.Config, manifestsDir string) {
+	image := createConfig.PodIdentityWebhookImage
+	if image == "" {
+		image = DefaultWebhookImage
+	}
+	data := webhookData{
+		Name:                 webhookName,
+		Namespace:            webhookNamespace,
+		Image:                image,
+		AnnotationPrefix:     annotationPrefix,
+		Audience:             Audience,
+		Region:               createConfig.Region,
+		STSRegionalEndpoints: createConfig.STSRegionalEndpoints,
+		Port:                 webhookPort,
+		CertDir:              webhookCertDir,
+	}
+
+	for _, manifest := range webhookManifests {
+		filePath := filepath.Join(manifestsDir, manifest.file)
+		if err := ioutil.WriteFile(filePath, []byte(render(manifest.file, manifest.template, data)), 0600); err != nil {
+			log.Panicf("Failed to save pod identity webhook file: %s", err)
+		}
+	}
+
+	log.Printf("Saved pod identity webhook manifests to: %s", manifestsDir)
+}
+
+func render(name, text string, data webhookData) string {
+	var b strings.Builder
+	if err := template.Must(template.New(name).Parse(text)).Execute(&b, data); err != nil {
+		log.Panicf("Failed to render %s: %s", name, err)
+	}
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package rollback
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/iamroles"
+	"github.com/sjenning/sts-preflight/pkg/s3endpoint"
+)
+
+// Run deletes the resources the journal records as created by the current
+// run, or by any run with all, newest first, taking each step off the journal
+// as it goes. Updates and deletions cannot be undone and are only reported.
+func Run(config create.Config, state *create.State, all bool) {
+	s, err := awssession.New(config)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	s3Client := s3.New(s)
+	iamClient := iam.New(s)
+
+	for i := len(state.Journal) - 1; i >= 0; i-- {
+		step := state.Journal[i]
+		if !all && !state.InRun(step) {
+			continue
+		}
+
+		if step.Action != create.StepCreated {
+			log.Printf("%s %s was %s and is left as it is", step.Kind, step.Name, step.Action)
+		} else {
+			switch step.Kind {
+			case create.KindBucket:
+				DeleteBucket(s3Client, step.Name)
+			case create.KindObject:
+				deleteObject(s3Client, step.Name)
+			case create.KindOIDCProvider:
+				DeleteOIDCProvider(iamClient, step.Name)
+			case create.KindRole:
+				DeleteRole(iamClient, step.Name)
+				if step.Name == s3endpoint.InstallerRoleName(config) {
+					state.RoleARN = ""
+				}
+			case create.KindPolicy:
+				iamroles.DeleteManagedPolicy(iamClient, step.Name)
+				state.RemovePolicyARN(step.Name)
+			default:
+				log.Panicf("Unknown kind %s of journaled step", step.Kind)
+			}
+		}
+
+		state.Journal = append(state.Journal[:i], state.Journal[i+1:]...)
+		state.Write()
+	}
+}
+
+// DeleteBucket empties the bucket of any object versions and delete markers,
+// which versioning leaves behind, and then deletes it.
+func DeleteBucket(s3Client *s3.S3, bucketName string) {
+	err := s3Client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: awssdk.String(bucketName),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		objects := []*s3.ObjectIdentifier{}
+		for _, version := range page.Versions {
+			objects = append(objects, &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+		}
+		for _, marker := range page.DeleteMarkers {
+			objects = append(objects, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+		}
+		if len(objects) == 0 {
+			return true
+		}
+		_, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: awssdk.String(bucketName),
+			Delete: &s3.Delete{Objects: objects, Quiet: awssdk.Bool(true)},
+		})
+		if err != nil {
+			log.Panicf("Failed to delete object versions: %s", err)
+		}
+		return true
+	})
+	if err != nil && !isNotFound(err, s3.ErrCodeNoSuchBucket) {
+		log.Panicf("Failed to list object versions: %s", err)
+	}
+
+	_, err = s3Client.DeleteBucket(&s3.DeleteBucketInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil && !isNotFound(err, s3.ErrCodeNoSuchBucket) {
+		log.Panicf("Failed to delete bucket: %s", err)
+	}
+	log.Print("Bucket ", bucketName, " deleted")
+}
+
+func deleteObject(s3Client *s3.S3, name string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		log.Panicf("Invalid object name %q in journal", name)
+	}
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: awssdk.String(parts[0]),
+		Key:    awssdk.String(parts[1]),
+	})
+	if err != nil && !isNotFound(err, s3.ErrCodeNoSuchBucket) {
+		log.Panicf("Failed to delete object: %s", err)
+	}
+	log.Print("Object ", name, " deleted")
+}
+
+// DeleteOIDCProvider deletes the OIDC provider, if it still exists.
+func DeleteOIDCProvider(iamClient *iam.IAM, providerARN string) {
+	_, err := iamClient.DeleteOpenIDConnectProvider(&iam.DeleteOpenIDConnectProviderInput{
+		OpenIDConnectProviderArn: awssdk.String(providerARN),
+	})
+	if err != nil && !isNotFound(err, iam.ErrCodeNoSuchEntityException) {
+		log.Panicf("Failed to delete OIDC provider: %s", err)
+	}
+	log.Print("OIDC provider ", providerARN, " deleted")
+}
+
+// DeleteRole removes the inline and attached policies of the role, which
+// IAM requires, and then the role itself.
+func DeleteRole(iamClient *iam.IAM, roleName string) {
+	err := iamClient.ListRolePoliciesPages(&iam.ListRolePoliciesInput{
+		RoleName: awssdk.String(roleName),
+	}, func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+		for _, policyName := range page.PolicyNames {
+			_, err := iamClient.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+				PolicyName: policyName,
+				RoleName:   awssdk.String(roleName),
+			})
+			if err != nil {
+				log.Panicf("Failed to delete role policy: %s", err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		if isNotFound(err, iam.ErrCodeNoSuchEntityException) {
+			return
+		}
+		log.Panicf("Failed to list role policies: %s", err)
+	}
+
+	err = iamClient.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{
+		RoleName: awssdk.String(roleName),
+	}, func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.AttachedPolicies {
+			_, err := iamClient.DetachRolePolicy(&iam.DetachRolePolicyInput{
+				PolicyArn: policy.PolicyArn,
+				RoleName:  awssdk.String(roleName),
+			})
+			if err != nil {
+				log.Panicf("Failed to detach policy: %s", err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Panicf("Failed to list attached role policies: %s", err)
+	}
+
+	_, err = iamClient.DeleteRole(&iam.DeleteRoleInput{
+		RoleName: awssdk.String(roleName),
+	})
+	if err != nil {
+		log.Panicf("Failed to delete role: %s", err)
+	}
+	log.Printf("Role %s deleted", roleName)
+}
+
+func isNotFound(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
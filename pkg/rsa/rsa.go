@@ -19,13 +19,18 @@ const (
 	publicKeyFile  = "sa-signer.pub"
 )
 
-func New(prefixDir string) {
+// New generates the signing key pair in prefixDir unless it exists. With
+// installerKey the private key is also copied to where openshift-install
+// expects it.
+func New(prefixDir string, installerKey bool) {
 
 	privateKeyFilePath := filepath.Join(prefixDir, privateKeyFile)
 	publicKeyFilePath := filepath.Join(prefixDir, publicKeyFile)
 	bitSize := 4096
 
-	defer copyPrivateKeyForInstaller(privateKeyFilePath, prefixDir)
+	if installerKey {
+		defer copyPrivateKeyForInstaller(privateKeyFilePath, prefixDir)
+	}
 
 	_, err := os.Stat(privateKeyFilePath)
 	if err == nil {
@@ -0,0 +1,406 @@
+package s3endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/sjenning/sts-preflight/pkg/awssession"
+	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/iamroles"
+)
+
+const (
+	// ObjectContentType and ObjectCacheControl are served with the
+	// discovery document and the JWKS.
+	ObjectContentType  = "application/json"
+	ObjectCacheControl = "max-age=300"
+
+	// lifecycleRuleID names the lifecycle rule create manages, leaving any
+	// other rules alone.
+	lifecycleRuleID = "sts-preflight"
+	// abortMultipartUploadDays is when the lifecycle rule cleans up
+	// incomplete multipart uploads.
+	abortMultipartUploadDays = 7
+)
+
+// bucketSetting is a bucket configuration create manages. diff returns why
+// the bucket differs from the config, or "" when it does not, and apply
+// brings the bucket in line.
+type bucketSetting struct {
+	name  string
+	diff  func(s3Client *s3.S3, config create.Config, bucketName string) (string, error)
+	apply func(s3Client *s3.S3, config create.Config, bucketName string) error
+}
+
+// bucketSettings returns the settings to manage. Public access, ownership
+// and the bucket policy always are; encryption, versioning, logging and the
+// lifecycle rule only when configured, and are otherwise left as they are.
+func bucketSettings(config create.Config) []bucketSetting {
+	settings := []bucketSetting{
+		{"public access block", diffPublicAccessBlock, applyPublicAccessBlock},
+		{"ownership controls", diffOwnershipControls, applyOwnershipControls},
+		{"bucket policy", diffBucketPolicy, applyBucketPolicy},
+	}
+	if config.BucketEncryption != "" {
+		settings = append(settings, bucketSetting{"default encryption", diffEncryption, applyEncryption})
+	}
+	if config.BucketVersioning {
+		settings = append(settings, bucketSetting{"versioning", diffVersioning, applyVersioning})
+	}
+	if config.BucketLoggingTarget != "" {
+		settings = append(settings, bucketSetting{"access logging", diffLogging, applyLogging})
+	}
+	if config.BucketNoncurrentVersionExpirationDays > 0 {
+		settings = append(settings, bucketSetting{"lifecycle rule", diffLifecycle, applyLifecycle})
+	}
+	return settings
+}
+
+// BucketSettingsDiff returns how the settings of the bucket differ from the
+// config, without changing anything.
+func BucketSettingsDiff(s3Client *s3.S3, config create.Config, bucketName string) ([]string, error) {
+	details := []string{}
+	for _, setting := range bucketSettings(config) {
+		detail, err := setting.diff(s3Client, config, bucketName)
+		if err != nil {
+			return nil, err
+		}
+		if detail != "" {
+			details = append(details, detail)
+		}
+	}
+	return details, nil
+}
+
+// reconcileBucketSettings brings the settings of the bucket in line with the
+// config. The public access block is relaxed before the public bucket policy
+// is put, which it would otherwise reject.
+func reconcileBucketSettings(s3Client *s3.S3, config create.Config, state *create.State, bucketName string) {
+	for _, setting := range bucketSettings(config) {
+		detail, err := setting.diff(s3Client, config, bucketName)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		if detail == "" {
+			continue
+		}
+		if err := setting.apply(s3Client, config, bucketName); err != nil {
+			log.Panicf("Failed to set %s of bucket %s: %s", setting.name, bucketName, err)
+		}
+		log.Printf("Bucket %s %s updated: %s", bucketName, setting.name, detail)
+		state.Record(create.KindBucket, bucketName, create.StepUpdated)
+	}
+}
+
+func isCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
+
+// The bucket policy makes the documents public, so only ACLs are blocked.
+func diffPublicAccessBlock(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	out, err := s3Client.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		if isCode(err, "NoSuchPublicAccessBlockConfiguration") {
+			return "public ACLs are not blocked", nil
+		}
+		return "", err
+	}
+	c := out.PublicAccessBlockConfiguration
+	if !awssdk.BoolValue(c.BlockPublicAcls) || !awssdk.BoolValue(c.IgnorePublicAcls) {
+		return "public ACLs are not blocked", nil
+	}
+	if awssdk.BoolValue(c.BlockPublicPolicy) || awssdk.BoolValue(c.RestrictPublicBuckets) {
+		return "public bucket policies are blocked", nil
+	}
+	return "", nil
+}
+
+func applyPublicAccessBlock(s3Client *s3.S3, config create.Config, bucketName string) error {
+	_, err := s3Client.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+		Bucket: awssdk.String(bucketName),
+		PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       awssdk.Bool(true),
+			IgnorePublicAcls:      awssdk.Bool(true),
+			BlockPublicPolicy:     awssdk.Bool(false),
+			RestrictPublicBuckets: awssdk.Bool(false),
+		},
+	})
+	return err
+}
+
+func diffOwnershipControls(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	out, err := s3Client.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		if isCode(err, "OwnershipControlsNotFoundError") {
+			return "ACLs are enabled", nil
+		}
+		return "", err
+	}
+	for _, rule := range out.OwnershipControls.Rules {
+		if awssdk.StringValue(rule.ObjectOwnership) == s3.ObjectOwnershipBucketOwnerEnforced {
+			return "", nil
+		}
+	}
+	return "ACLs are enabled", nil
+}
+
+func applyOwnershipControls(s3Client *s3.S3, config create.Config, bucketName string) error {
+	_, err := s3Client.PutBucketOwnershipControls(&s3.PutBucketOwnershipControlsInput{
+		Bucket: awssdk.String(bucketName),
+		OwnershipControls: &s3.OwnershipControls{
+			Rules: []*s3.OwnershipControlsRule{
+				{ObjectOwnership: awssdk.String(s3.ObjectOwnershipBucketOwnerEnforced)},
+			},
+		},
+	})
+	return err
+}
+
+// BucketPolicy returns the policy that lets anyone, IAM included, read the
+// discovery document and the JWKS, and nothing else.
+func BucketPolicy(config create.Config, bucketName string) string {
+	partition := awssession.Partition(config.Region).ID()
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Sid":       "PublicReadIssuerDocuments",
+				"Effect":    "Allow",
+				"Principal": "*",
+				"Action":    "s3:GetObject",
+				"Resource": []string{
+					fmt.Sprintf("arn:%s:s3:::%s/%s", partition, bucketName, DiscoveryURI),
+					fmt.Sprintf("arn:%s:s3:::%s/%s", partition, bucketName, KeysURI),
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(policy)
+	if err != nil {
+		log.Panicf("Failed to marshal the bucket policy to JSON: %s", err)
+	}
+	return string(b)
+}
+
+func diffBucketPolicy(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	out, err := s3Client.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		if isCode(err, "NoSuchBucketPolicy") {
+			return "no bucket policy", nil
+		}
+		return "", err
+	}
+	if !iamroles.PolicyDocumentsEqual(awssdk.StringValue(out.Policy), BucketPolicy(config, bucketName)) {
+		return "bucket policy differs", nil
+	}
+	return "", nil
+}
+
+func applyBucketPolicy(s3Client *s3.S3, config create.Config, bucketName string) error {
+	_, err := s3Client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: awssdk.String(bucketName),
+		Policy: awssdk.String(BucketPolicy(config, bucketName)),
+	})
+	return err
+}
+
+// sseAlgorithm returns the S3 algorithm of the configured encryption.
+func sseAlgorithm(config create.Config) string {
+	if config.BucketEncryption == create.BucketEncryptionSSEKMS {
+		return s3.ServerSideEncryptionAwsKms
+	}
+	return s3.ServerSideEncryptionAes256
+}
+
+func diffEncryption(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	out, err := s3Client.GetBucketEncryption(&s3.GetBucketEncryptionInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		if isCode(err, "ServerSideEncryptionConfigurationNotFoundError") {
+			return "no default encryption", nil
+		}
+		return "", err
+	}
+	for _, rule := range out.ServerSideEncryptionConfiguration.Rules {
+		byDefault := rule.ApplyServerSideEncryptionByDefault
+		if byDefault == nil {
+			continue
+		}
+		algorithm := awssdk.StringValue(byDefault.SSEAlgorithm)
+		keyID := awssdk.StringValue(byDefault.KMSMasterKeyID)
+		if algorithm != sseAlgorithm(config) || keyID != config.BucketKMSKeyID {
+			return fmt.Sprintf("default encryption is %s %s", algorithm, keyID), nil
+		}
+		return "", nil
+	}
+	return "no default encryption", nil
+}
+
+func applyEncryption(s3Client *s3.S3, config create.Config, bucketName string) error {
+	byDefault := &s3.ServerSideEncryptionByDefault{
+		SSEAlgorithm: awssdk.String(sseAlgorithm(config)),
+	}
+	if config.BucketKMSKeyID != "" {
+		byDefault.KMSMasterKeyID = awssdk.String(config.BucketKMSKeyID)
+	}
+	_, err := s3Client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: awssdk.String(bucketName),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{
+				{
+					ApplyServerSideEncryptionByDefault: byDefault,
+					BucketKeyEnabled:                   awssdk.Bool(config.BucketEncryption == create.BucketEncryptionSSEKMS),
+				},
+			},
+		},
+	})
+	return err
+}
+
+func diffVersioning(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	out, err := s3Client.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		return "", err
+	}
+	if status := awssdk.StringValue(out.Status); status != s3.BucketVersioningStatusEnabled {
+		return "versioning is not enabled", nil
+	}
+	return "", nil
+}
+
+func applyVersioning(s3Client *s3.S3, config create.Config, bucketName string) error {
+	_, err := s3Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: awssdk.String(bucketName),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: awssdk.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	return err
+}
+
+// loggingTarget splits the <bucket>[/<prefix>] logging target. The prefix
+// defaults to the name of the logged bucket.
+func loggingTarget(config create.Config, bucketName string) (string, string) {
+	parts := strings.SplitN(config.BucketLoggingTarget, "/", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		return parts[0], parts[1]
+	}
+	return parts[0], bucketName + "/"
+}
+
+func diffLogging(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	out, err := s3Client.GetBucketLogging(&s3.GetBucketLoggingInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.LoggingEnabled == nil {
+		return "access logging is disabled", nil
+	}
+	targetBucket, targetPrefix := loggingTarget(config, bucketName)
+	currentBucket := awssdk.StringValue(out.LoggingEnabled.TargetBucket)
+	currentPrefix := awssdk.StringValue(out.LoggingEnabled.TargetPrefix)
+	if currentBucket != targetBucket || currentPrefix != targetPrefix {
+		return fmt.Sprintf("access logs go to %s/%s", currentBucket, currentPrefix), nil
+	}
+	return "", nil
+}
+
+func applyLogging(s3Client *s3.S3, config create.Config, bucketName string) error {
+	targetBucket, targetPrefix := loggingTarget(config, bucketName)
+	_, err := s3Client.PutBucketLogging(&s3.PutBucketLoggingInput{
+		Bucket: awssdk.String(bucketName),
+		BucketLoggingStatus: &s3.BucketLoggingStatus{
+			LoggingEnabled: &s3.LoggingEnabled{
+				TargetBucket: awssdk.String(targetBucket),
+				TargetPrefix: awssdk.String(targetPrefix),
+			},
+		},
+	})
+	return err
+}
+
+// lifecycleRule expires replaced versions of the documents and cleans up
+// incomplete uploads. The current documents never expire.
+func lifecycleRule(config create.Config) *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:     awssdk.String(lifecycleRuleID),
+		Status: awssdk.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: awssdk.String("")},
+		NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: awssdk.Int64(config.BucketNoncurrentVersionExpirationDays),
+		},
+		AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: awssdk.Int64(abortMultipartUploadDays),
+		},
+	}
+}
+
+// currentLifecycleRules returns the lifecycle rules of the bucket.
+func currentLifecycleRules(s3Client *s3.S3, bucketName string) ([]*s3.LifecycleRule, error) {
+	out, err := s3Client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: awssdk.String(bucketName),
+	})
+	if err != nil {
+		if isCode(err, "NoSuchLifecycleConfiguration") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out.Rules, nil
+}
+
+func diffLifecycle(s3Client *s3.S3, config create.Config, bucketName string) (string, error) {
+	rules, err := currentLifecycleRules(s3Client, bucketName)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range rules {
+		if awssdk.StringValue(rule.ID) != lifecycleRuleID {
+			continue
+		}
+		if awssdk.StringValue(rule.Status) != s3.ExpirationStatusEnabled ||
+			rule.NoncurrentVersionExpiration == nil ||
+			awssdk.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays) != config.BucketNoncurrentVersionExpirationDays {
+			return fmt.Sprintf("lifecycle rule %s differs", lifecycleRuleID), nil
+		}
+		return "", nil
+	}
+	return fmt.Sprintf("no lifecycle rule %s", lifecycleRuleID), nil
+}
+
+func applyLifecycle(s3Client *s3.S3, config create.Config, bucketName string) error {
+	rules, err := currentLifecycleRules(s3Client, bucketName)
+	if err != nil {
+		return err
+	}
+	wanted := []*s3.LifecycleRule{lifecycleRule(config)}
+	for _, rule := range rules {
+		if awssdk.StringValue(rule.ID) != lifecycleRuleID {
+			wanted = append(wanted, rule)
+		}
+	}
+	_, err = s3Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 awssdk.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: wanted},
+	})
+	return err
+}
@@ -1,33 +1,73 @@
 package s3endpoint
 
 import (
+	"bytes"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 
 	awssdk "github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
+	credreqv1 "github.com/openshift/cloud-credential-operator/pkg/apis/cloudcredential/v1"
+	"gopkg.in/yaml.v2"
 
+	"github.com/sjenning/sts-preflight/pkg/awssession"
 	"github.com/sjenning/sts-preflight/pkg/cmd/create"
+	"github.com/sjenning/sts-preflight/pkg/credreqs"
 	"github.com/sjenning/sts-preflight/pkg/iamroles"
+	"github.com/sjenning/sts-preflight/pkg/installerpolicy"
+	"github.com/sjenning/sts-preflight/pkg/kubeapiserver"
+	"github.com/sjenning/sts-preflight/pkg/oidcissuer"
+	"github.com/sjenning/sts-preflight/pkg/podidentity"
 )
 
 const (
 	manifestsDir                  = "manifests"
 	clusterAuthenticationFilename = "cluster-authentication-02-config.yaml"
+	cloudCredentialFilename       = "cco-cloudcredential-config.yaml"
+	ccoConfigMapFilename          = "cco-configmap.yaml"
 	boundSAKeyFilename            = "bound-service-account-signing-key.key"
+
+	administratorAccessPolicyName  = "AdministratorAccess"
+	installerPermissionsPolicyName = "installer-permissions"
+	installerInlinePolicyName      = "installer-inline-policy"
+
+	// OIDCClientID is the audience of the OIDC provider.
+	OIDCClientID = "openshift"
 )
 
 var (
-	discoveryURI      = ".well-known/openid-configuration"
-	keysURI           = "keys.json"
+	rolePolicyTemplate = `{
+	"Version": "2012-10-17",
+	"Statement": [
+		{
+			"Effect": "Allow",
+			"Principal": {
+				"Federated": "%s"
+			},
+			"Action": "sts:AssumeRoleWithWebIdentity",
+			"Condition": {
+				"StringEquals": {
+					"%s:aud": "openshift"
+				}
+			}
+		}
+	]
+}`
+	// InstallerInlinePolicyNames are the inline policies the installer role
+	// may have.
+	InstallerInlinePolicyNames = []string{installerPermissionsPolicyName, installerInlinePolicyName}
+
+	DiscoveryURI      = ".well-known/openid-configuration"
+	KeysURI           = "keys.json"
 	discoveryTemplate = `{
 	"issuer": "%s",
 	"jwks_uri": "%s/%s",
@@ -51,35 +91,115 @@ var (
 }`
 )
 
-func New(config create.Config, state *create.State) {
+// BucketName returns the name of the bucket hosting the OIDC documents.
+func BucketName(config create.Config) string {
+	return fmt.Sprintf("%s-installer", config.InfraName)
+}
+
+// InstallerRoleName returns the name of the installer role.
+func InstallerRoleName(config create.Config) string {
+	return fmt.Sprintf("%s-installer", config.InfraName)
+}
+
+// IssuerURL returns the OIDC issuer URL, without the https:// prefix.
+func IssuerURL(config create.Config) string {
+	if config.ExternalIssuerURL != "" {
+		return strings.TrimPrefix(strings.TrimSuffix(config.ExternalIssuerURL, "/"), "https://")
+	}
+	return fmt.Sprintf("%s/%s", awssession.S3Host(config.Region), BucketName(config))
+}
+
+// DiscoveryDocument returns the OIDC discovery document for the issuer.
+func DiscoveryDocument(issuerURLWithProto string) string {
+	return fmt.Sprintf(discoveryTemplate, issuerURLWithProto, issuerURLWithProto, KeysURI)
+}
+
+// InstallerTrustPolicy returns the trust policy of the installer role.
+func InstallerTrustPolicy(providerARN, issuerURL string) string {
+	return fmt.Sprintf(rolePolicyTemplate, providerARN, issuerURL)
+}
+
+func New(config create.Config, state *create.State, crs []credreqs.CredentialsRequest, sas []podidentity.ServiceAccountRole) {
 	manifestsDirPath := filepath.Join(config.TargetDir, manifestsDir)
 	if err := os.RemoveAll(manifestsDirPath); err != nil {
-		log.Fatalf("failed to clean up manifests directory: %s", err)
+		log.Panicf("failed to clean up manifests directory: %s", err)
 	}
 	if err := os.MkdirAll(manifestsDirPath, 0700); err != nil {
-		log.Fatalf("failed to create manifests directory: %s", err)
+		log.Panicf("failed to create manifests directory: %s", err)
 	}
 
-	bucketName := fmt.Sprintf("%s-installer", config.InfraName)
-	roleName := bucketName
-	issuerURL := fmt.Sprintf("s3.%s.amazonaws.com/%s", config.Region, bucketName)
+	bucketName := BucketName(config)
+	roleName := InstallerRoleName(config)
+	issuerURL := IssuerURL(config)
 	issuerURLWithProto := fmt.Sprintf("https://%s", issuerURL)
 
-	cfg := &awssdk.Config{
-		Region: awssdk.String(config.Region),
-	}
-
-	s, err := session.NewSession(cfg)
+	s, err := awssession.New(config)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Panic(err.Error())
 	}
 
 	s3Client := s3.New(s)
 	iamClient := iam.New(s)
 
-	_, err = s3Client.CreateBucket(&s3.CreateBucketInput{
+	var thumbprint string
+	if config.ExternalIssuerURL != "" {
+		issuer, err := oidcissuer.Discover(config.ExternalIssuerURL, config.CABundle)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		thumbprint = issuer.Thumbprint
+	} else {
+		thumbprint, err = S3Thumbprint(config)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+
+		reconcileBucket(s3Client, config, state, bucketName)
+
+		reconcileObject(s3Client, state, bucketName, DiscoveryURI, []byte(DiscoveryDocument(issuerURLWithProto)))
+
+		keysJSON, err := ioutil.ReadFile(filepath.Join(config.TargetDir, "keys.json"))
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		reconcileObject(s3Client, state, bucketName, KeysURI, keysJSON)
+	}
+
+	providerARN := reconcileOIDCProvider(iamClient, config, state, issuerURL, thumbprint)
+
+	state.RoleARN = reconcileInstallerRole(iamClient, config, state, roleName, InstallerTrustPolicy(providerARN, issuerURL))
+
+	setInstallerPermissions(iamClient, config, state, roleName)
+
+	if config.Target == create.TargetKubernetes {
+		if config.ExternalIssuerURL == "" {
+			kubeapiserver.Write(config, issuerURLWithProto)
+		}
+	} else {
+		createClusterAuthentication(issuerURLWithProto, manifestsDirPath)
+		createCloudCredential(manifestsDirPath)
+	}
+
+	iamroles.Create(iamClient, config, state, crs, manifestsDirPath, providerARN, issuerURL)
+
+	if len(sas) > 0 {
+		iamroles.CreateForServiceAccounts(iamClient, config, state, sas, manifestsDirPath, providerARN, issuerURL)
+		podidentity.WriteWebhook(config, manifestsDirPath)
+	}
+}
+
+// reconcileBucket creates the bucket or brings the tags and settings of an
+// existing one in line with the config.
+func reconcileBucket(s3Client *s3.S3, config create.Config, state *create.State, bucketName string) {
+	input := &s3.CreateBucketInput{
 		Bucket: awssdk.String(bucketName),
-	})
+	}
+	if constraint := awssession.BucketLocationConstraint(config.Region); constraint != "" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: awssdk.String(constraint),
+		}
+	}
+	_, err := s3Client.CreateBucket(input)
 	if err != nil {
 		var aerr awserr.Error
 		if errors.As(err, &aerr) {
@@ -87,55 +207,108 @@ func New(config create.Config, state *create.State) {
 			case s3.ErrCodeBucketAlreadyOwnedByYou:
 				log.Print("Bucket ", bucketName, " already exists and is owned by us")
 			default:
-				log.Fatal(aerr.Error())
+				log.Panic(aerr.Error())
 			}
 		} else {
-			log.Fatal(err.Error())
+			log.Panic(err.Error())
 		}
 	} else {
 		log.Print("Bucket ", bucketName, " created")
+		state.Record(create.KindBucket, bucketName, create.StepCreated)
 	}
 
-	discoveryJSON := fmt.Sprintf(discoveryTemplate, issuerURLWithProto, issuerURLWithProto, keysURI)
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		ACL:    awssdk.String("public-read"),
-		Body:   awssdk.ReadSeekCloser(strings.NewReader(discoveryJSON)),
+	current := map[string]string{}
+	tagging, err := s3Client.GetBucketTagging(&s3.GetBucketTaggingInput{
 		Bucket: awssdk.String(bucketName),
-		Key:    awssdk.String(discoveryURI),
 	})
 	if err != nil {
-		log.Fatal(err.Error())
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == "NoSuchTagSet") {
+			log.Panic(err.Error())
+		}
+	} else {
+		for _, tag := range tagging.TagSet {
+			current[awssdk.StringValue(tag.Key)] = awssdk.StringValue(tag.Value)
+		}
+	}
+
+	// PutBucketTagging replaces the whole tag set, so the tags others put
+	// on the bucket are kept alongside ours.
+	merged := MergedBucketTags(current, config.ResourceTags())
+	if !reflect.DeepEqual(current, merged) {
+		_, err = s3Client.PutBucketTagging(&s3.PutBucketTaggingInput{
+			Bucket: awssdk.String(bucketName),
+			Tagging: &s3.Tagging{
+				TagSet: s3Tags(merged),
+			},
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print("Bucket ", bucketName, " tags updated")
+		state.Record(create.KindBucket, bucketName, create.StepUpdated)
 	}
-	log.Print("OIDC discovery document at ", discoveryURI, " updated")
 
-	keysPath := filepath.Join(config.TargetDir, "keys.json")
-	f, err := os.Open(keysPath)
+	reconcileBucketSettings(s3Client, config, state, bucketName)
+}
+
+// reconcileObject uploads the object unless the bucket already holds the
+// same content with the same headers. Objects are always encrypted with S3
+// managed keys, even in SSE-KMS buckets, so that anyone can read them and
+// their ETag stays the MD5 of the content.
+func reconcileObject(s3Client *s3.S3, state *create.State, bucketName, key string, content []byte) {
+	action := create.StepUpdated
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: awssdk.String(bucketName),
+		Key:    awssdk.String(key),
+	})
 	if err != nil {
-		log.Fatal(err.Error())
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == "NotFound") {
+			log.Panic(err.Error())
+		}
+		action = create.StepCreated
+	} else if ObjectUpToDate(head, content) {
+		log.Print(key, " is up to date")
+		return
 	}
 
 	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		ACL:    awssdk.String("public-read"),
-		Body:   awssdk.ReadSeekCloser(f),
-		Bucket: awssdk.String(bucketName),
-		Key:    awssdk.String(keysURI),
+		Body:                 bytes.NewReader(content),
+		Bucket:               awssdk.String(bucketName),
+		Key:                  awssdk.String(key),
+		ContentType:          awssdk.String(ObjectContentType),
+		CacheControl:         awssdk.String(ObjectCacheControl),
+		ServerSideEncryption: awssdk.String(s3.ServerSideEncryptionAes256),
 	})
-	f.Close()
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Panic(err.Error())
 	}
-	log.Print("JWKS at ", keysURI, " updated")
+	log.Print(key, " updated")
+	state.Record(create.KindObject, bucketName+"/"+key, action)
+}
 
+// ObjectUpToDate returns whether the object holds the content, served with
+// the expected headers.
+func ObjectUpToDate(head *s3.HeadObjectOutput, content []byte) bool {
+	return strings.Trim(awssdk.StringValue(head.ETag), `"`) == fmt.Sprintf("%x", md5.Sum(content)) &&
+		awssdk.StringValue(head.ContentType) == ObjectContentType &&
+		awssdk.StringValue(head.CacheControl) == ObjectCacheControl
+}
+
+// reconcileOIDCProvider creates the OIDC provider for the issuer, or brings
+// the client IDs, thumbprints and tags of the existing one in line, and
+// returns its ARN.
+func reconcileOIDCProvider(iamClient *iam.IAM, config create.Config, state *create.State, issuerURL, thumbprint string) string {
 	oidcProviderList, err := iamClient.ListOpenIDConnectProviders(&iam.ListOpenIDConnectProvidersInput{})
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Panic(err.Error())
 	}
 
 	var providerARN string
 	for _, provider := range oidcProviderList.OpenIDConnectProviderList {
-		if strings.Contains(*provider.Arn, bucketName) {
+		if strings.HasSuffix(*provider.Arn, ":oidc-provider/"+issuerURL) {
 			providerARN = *provider.Arn
-			log.Print("Existing OIDC provider found ", providerARN)
 			break
 		}
 	}
@@ -143,80 +316,305 @@ func New(config create.Config, state *create.State) {
 	if len(providerARN) == 0 {
 		oidcOutput, err := iamClient.CreateOpenIDConnectProvider(&iam.CreateOpenIDConnectProviderInput{
 			ClientIDList: []*string{
-				awssdk.String("openshift"),
+				awssdk.String(OIDCClientID),
 			},
 			ThumbprintList: []*string{
-				awssdk.String("A9D53002E97E00E043244F3D170D6F4C414104FD"), // root CA thumbprint for s3 (DigiCert)
+				awssdk.String(thumbprint),
 			},
-			Url: awssdk.String(issuerURLWithProto),
+			Url:  awssdk.String("https://" + issuerURL),
+			Tags: iamroles.IAMTags(config.ResourceTags()),
 		})
 		if err != nil {
-			log.Fatal(err.Error())
+			log.Panic(err.Error())
 		}
 
 		providerARN = *oidcOutput.OpenIDConnectProviderArn
 		log.Print("OIDC provider created ", providerARN)
+		state.Record(create.KindOIDCProvider, providerARN, create.StepCreated)
+		return providerARN
 	}
 
-	rolePolicyTemplate := `{
-	"Version": "2012-10-17",
-	"Statement": [
-		{
-			"Effect": "Allow",
-			"Principal": {
-				"Federated": "%s"
-			},
-				"Action": "sts:AssumeRoleWithWebIdentity",
-			"Condition": {
-				"StringEquals": {
-					"%s:aud": "openshift"
-				}
-			}
+	log.Print("Existing OIDC provider found ", providerARN)
+	provider, err := iamClient.GetOpenIDConnectProvider(&iam.GetOpenIDConnectProviderInput{
+		OpenIDConnectProviderArn: awssdk.String(providerARN),
+	})
+	if err != nil {
+		log.Panic(err.Error())
+	}
+
+	for _, clientID := range provider.ClientIDList {
+		if *clientID == OIDCClientID {
+			continue
 		}
-	]
-}`
+		_, err := iamClient.RemoveClientIDFromOpenIDConnectProvider(&iam.RemoveClientIDFromOpenIDConnectProviderInput{
+			ClientID:                 clientID,
+			OpenIDConnectProviderArn: awssdk.String(providerARN),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print("Client ID ", *clientID, " removed from OIDC provider")
+		state.Record(create.KindOIDCProvider, providerARN, create.StepUpdated)
+	}
+	if !containsString(awssdk.StringValueSlice(provider.ClientIDList), OIDCClientID) {
+		_, err := iamClient.AddClientIDToOpenIDConnectProvider(&iam.AddClientIDToOpenIDConnectProviderInput{
+			ClientID:                 awssdk.String(OIDCClientID),
+			OpenIDConnectProviderArn: awssdk.String(providerARN),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print("Client ID ", OIDCClientID, " added to OIDC provider")
+		state.Record(create.KindOIDCProvider, providerARN, create.StepUpdated)
+	}
 
-	roleList, err := iamClient.ListRoles(&iam.ListRolesInput{MaxItems: awssdk.Int64(500)})
-	if err != nil {
-		log.Fatal(err.Error())
+	if thumbprints := awssdk.StringValueSlice(provider.ThumbprintList); len(thumbprints) != 1 || !strings.EqualFold(thumbprints[0], thumbprint) {
+		_, err := iamClient.UpdateOpenIDConnectProviderThumbprint(&iam.UpdateOpenIDConnectProviderThumbprintInput{
+			OpenIDConnectProviderArn: awssdk.String(providerARN),
+			ThumbprintList:           []*string{awssdk.String(thumbprint)},
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print("OIDC provider thumbprints updated from ", thumbprints)
+		state.Record(create.KindOIDCProvider, providerARN, create.StepUpdated)
 	}
 
-	var roleARN string
-	for _, role := range roleList.Roles {
-		if *role.RoleName == roleName {
-			roleARN = *role.Arn
-			log.Print("Existing Role found ", roleARN)
-			break
+	if tags := iamroles.ChangedTags(provider.Tags, config.ResourceTags()); len(tags) > 0 {
+		_, err := iamClient.TagOpenIDConnectProvider(&iam.TagOpenIDConnectProviderInput{
+			OpenIDConnectProviderArn: awssdk.String(providerARN),
+			Tags:                     tags,
+		})
+		if err != nil {
+			log.Panic(err.Error())
 		}
+		log.Print("OIDC provider tags updated")
+		state.Record(create.KindOIDCProvider, providerARN, create.StepUpdated)
 	}
 
-	if len(roleARN) == 0 {
-		roleOutput, err := iamClient.CreateRole(&iam.CreateRoleInput{
+	return providerARN
+}
+
+// reconcileInstallerRole creates the installer role, or brings the trust
+// policy and metadata of the existing one in line, and returns its ARN.
+func reconcileInstallerRole(iamClient *iam.IAM, config create.Config, state *create.State, roleName, trustPolicy string) string {
+	roleOutput, err := iamClient.GetRole(&iam.GetRoleInput{
+		RoleName: awssdk.String(roleName),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+			log.Panic(err.Error())
+		}
+
+		input := &iam.CreateRoleInput{
 			RoleName:                 awssdk.String(roleName),
-			AssumeRolePolicyDocument: awssdk.String(fmt.Sprintf(rolePolicyTemplate, providerARN, issuerURL)),
-		})
+			AssumeRolePolicyDocument: awssdk.String(trustPolicy),
+		}
+		iamroles.SetRoleMetadata(input, config)
+
+		createOutput, err := iamClient.CreateRole(input)
 		if err != nil {
-			log.Fatal(err.Error())
+			log.Panic(err.Error())
 		}
 
-		roleARN = *roleOutput.Role.Arn
-		log.Print("Role created ", roleARN)
+		log.Print("Role created ", *createOutput.Role.Arn)
+		state.Record(create.KindRole, roleName, create.StepCreated)
+		return *createOutput.Role.Arn
 	}
 
-	state.RoleARN = roleARN
+	role := roleOutput.Role
+	log.Print("Existing Role found ", *role.Arn)
 
-	_, err = iamClient.AttachRolePolicy(&iam.AttachRolePolicyInput{
-		PolicyArn: awssdk.String("arn:aws:iam::aws:policy/AdministratorAccess"),
-		RoleName:  awssdk.String(roleName),
+	if iamroles.UpdateRoleMetadata(iamClient, role, config) {
+		state.Record(create.KindRole, roleName, create.StepUpdated)
+	}
+
+	if !iamroles.PolicyDocumentsEqual(awssdk.StringValue(role.AssumeRolePolicyDocument), trustPolicy) {
+		_, err := iamClient.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+			RoleName:       role.RoleName,
+			PolicyDocument: awssdk.String(trustPolicy),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print("Trust policy of Role ", roleName, " updated")
+		state.Record(create.KindRole, roleName, create.StepUpdated)
+	}
+
+	return *role.Arn
+}
+
+// setInstallerPermissions grants the installer role the configured
+// permissions, falling back to AdministratorAccess when none are configured.
+// Policies attached by a previous run that are no longer wanted are removed;
+// policies attached by others are left alone.
+func setInstallerPermissions(iamClient *iam.IAM, config create.Config, state *create.State, roleName string) {
+	policyARNs, inlinePolicies := InstallerPermissions(config)
+
+	attached := []string{}
+	err := iamClient.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{
+		RoleName: awssdk.String(roleName),
+	}, func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.AttachedPolicies {
+			attached = append(attached, *policy.PolicyArn)
+		}
+		return true
 	})
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Panic(err.Error())
+	}
+
+	for _, policyARN := range attached {
+		if containsString(policyARNs, policyARN) || !OwnsInstallerPolicy(config, state.InstallerPolicyARNs, policyARN) {
+			continue
+		}
+		_, err := iamClient.DetachRolePolicy(&iam.DetachRolePolicyInput{
+			PolicyArn: awssdk.String(policyARN),
+			RoleName:  awssdk.String(roleName),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print(policyARN, " detached from Role ", roleName)
+		state.RemoveInstallerPolicyARN(policyARN)
+		state.Record(create.KindRole, roleName, create.StepUpdated)
+	}
+
+	for _, policyARN := range policyARNs {
+		if containsString(attached, policyARN) {
+			continue
+		}
+		_, err := iamClient.AttachRolePolicy(&iam.AttachRolePolicyInput{
+			PolicyArn: awssdk.String(policyARN),
+			RoleName:  awssdk.String(roleName),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print(policyARN, " attached to Role ", roleName)
+		state.AddInstallerPolicyARN(policyARN)
+		state.Record(create.KindRole, roleName, create.StepUpdated)
+	}
+
+	for _, policyName := range InstallerInlinePolicyNames {
+		current, err := iamClient.GetRolePolicy(&iam.GetRolePolicyInput{
+			PolicyName: awssdk.String(policyName),
+			RoleName:   awssdk.String(roleName),
+		})
+		var aerr awserr.Error
+		if err != nil && !(errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+			log.Panic(err.Error())
+		}
+		exists := err == nil
+
+		policy, ok := inlinePolicies[policyName]
+		if !ok {
+			if !exists {
+				continue
+			}
+			_, err := iamClient.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+				PolicyName: awssdk.String(policyName),
+				RoleName:   awssdk.String(roleName),
+			})
+			if err != nil {
+				log.Panic(err.Error())
+			}
+			log.Print("Inline policy ", policyName, " deleted from Role ", roleName)
+			state.Record(create.KindRole, roleName, create.StepUpdated)
+			continue
+		}
+
+		if exists && iamroles.PolicyDocumentsEqual(awssdk.StringValue(current.PolicyDocument), policy) {
+			continue
+		}
+		_, err = iamClient.PutRolePolicy(&iam.PutRolePolicyInput{
+			PolicyDocument: awssdk.String(policy),
+			PolicyName:     awssdk.String(policyName),
+			RoleName:       awssdk.String(roleName),
+		})
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		log.Print("Inline policy ", policyName, " put on Role ", roleName)
+		state.Record(create.KindRole, roleName, create.StepUpdated)
 	}
-	log.Print("AdministratorAccess attached to Role ", roleName)
+}
 
-	createClusterAuthentication(issuerURLWithProto, manifestsDirPath)
+// OwnsInstallerPolicy reports whether create attached the managed policy to
+// the installer role: it is recorded in the state, or it is
+// AdministratorAccess, which earlier releases attached without recording it.
+func OwnsInstallerPolicy(config create.Config, recorded []string, policyARN string) bool {
+	return containsString(recorded, policyARN) || policyARN == awssession.AWSManagedPolicyARN(config.Region, administratorAccessPolicyName)
+}
+
+// InstallerPermissions returns the managed policies to attach to the
+// installer role and its inline policies by name. AdministratorAccess is used
+// when no permissions are configured.
+func InstallerPermissions(config create.Config) ([]string, map[string]string) {
+	policyARNs := config.InstallerPolicyARNs
+	if len(policyARNs) == 0 && len(config.InstallerFeatures) == 0 && config.InstallerInlinePolicyFile == "" {
+		policyARNs = []string{awssession.AWSManagedPolicyARN(config.Region, administratorAccessPolicyName)}
+	}
+
+	inlinePolicies := map[string]string{}
+	if len(config.InstallerFeatures) > 0 {
+		inlinePolicies[installerPermissionsPolicyName] = installerpolicy.New(config.InstallerFeatures)
+	}
+	if config.InstallerInlinePolicyFile != "" {
+		policy, err := ioutil.ReadFile(config.InstallerInlinePolicyFile)
+		if err != nil {
+			log.Panicf("failed to read installer inline policy file: %s", err)
+		}
+		if err := installerpolicy.Validate(policy); err != nil {
+			log.Panicf("invalid installer inline policy file %s: %s", config.InstallerInlinePolicyFile, err)
+		}
+		inlinePolicies[installerInlinePolicyName] = string(policy)
+	}
 
-	iamroles.Create(config, manifestsDirPath, providerARN, issuerURL)
+	return policyARNs, inlinePolicies
+}
+
+// S3Thumbprint returns the thumbprint of the certificate chain of the
+// regional S3 host serving the issuer, whose root CA differs between
+// partitions. Tests against a fake AWS, which does not serve that host,
+// replace it.
+var S3Thumbprint = func(config create.Config) (string, error) {
+	return oidcissuer.Thumbprint(awssession.S3Host(config.Region), config.CABundle)
+}
+
+// MergedBucketTags returns the current bucket tags with the wanted ones added
+// or updated.
+func MergedBucketTags(current, wanted map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range current {
+		merged[k] = v
+	}
+	for k, v := range wanted {
+		merged[k] = v
+	}
+	return merged
+}
+
+// s3Tags converts a tag map into S3 tags, sorted by key.
+func s3Tags(tags map[string]string) []*s3.Tag {
+	s3Tags := []*s3.Tag{}
+	for _, tag := range iamroles.IAMTags(tags) {
+		s3Tags = append(s3Tags, &s3.Tag{
+			Key:   tag.Key,
+			Value: tag.Value,
+		})
+	}
+	return s3Tags
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 func createClusterAuthentication(oidcURL, manifestsDir string) {
@@ -231,6 +629,65 @@ spec:
 
 	fileData := fmt.Sprintf(clusterAuthenticationTemplate, oidcURL)
 	if err := ioutil.WriteFile(clusterAuthFilepath, []byte(fileData), 0600); err != nil {
-		log.Fatalf("failed to save cluster authentication file: %s", err)
+		log.Panicf("failed to save cluster authentication file: %s", err)
+	}
+}
+
+// cloudCredential is the operator.openshift.io/v1 CloudCredential, with
+// the fields create sets.
+type cloudCredential struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		CredentialsMode string `yaml:"credentialsMode"`
+		ManagementState string `yaml:"managementState"`
+	} `yaml:"spec"`
+}
+
+// configMap is a v1 ConfigMap.
+type configMap struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Data map[string]string `yaml:"data"`
+}
+
+// createCloudCredential puts the cloud-credential-operator in Manual mode, so
+// that it leaves the Secrets written for the CredentialsRequests alone
+// instead of minting credentials from a root credential. Releases before the
+// CloudCredential credentialsMode read the disabled key of the operator's
+// ConfigMap instead, so that is written too.
+func createCloudCredential(manifestsDir string) {
+	var cc cloudCredential
+	cc.APIVersion = "operator.openshift.io/v1"
+	cc.Kind = "CloudCredential"
+	cc.Metadata.Name = "cluster"
+	cc.Spec.CredentialsMode = "Manual"
+	cc.Spec.ManagementState = "Managed"
+	writeManifest(manifestsDir, cloudCredentialFilename, cc)
+
+	var cm configMap
+	cm.APIVersion = "v1"
+	cm.Kind = "ConfigMap"
+	cm.Metadata.Name = "cloud-credential-operator-config"
+	cm.Metadata.Namespace = credreqv1.CloudCredOperatorNamespace
+	cm.Data = map[string]string{"disabled": "true"}
+	writeManifest(manifestsDir, ccoConfigMapFilename, cm)
+}
+
+func writeManifest(manifestsDir, filename string, manifest interface{}) {
+	manifestBytes, err := yaml.Marshal(manifest)
+	if err != nil {
+		log.Panicf("failed to marshal %s: %s", filename, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(manifestsDir, filename), manifestBytes, 0600); err != nil {
+		log.Panicf("failed to save %s: %s", filename, err)
 	}
 }